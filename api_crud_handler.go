@@ -7,9 +7,6 @@ import (
 	"github.com/labstack/echo"
 )
 
-// logged in user object
-var LoggedInUser User
-
 func apiCreateHandler(ctx echo.Context) error {
 	var err error
 
@@ -56,6 +53,24 @@ func apiReadHandler(ctx echo.Context) error {
 
 	item.postRead()
 
+	if p, ok := item.(profileProjector); ok {
+		viewer, err := verifySession(ctx)
+		if err != nil {
+			return ctx.JSON(http.StatusUnauthorized, err.Error())
+		}
+
+		// Other members are hidden the same way userProfileHandler hides them
+		if u, ok := item.(*User); ok && u.UUID != viewer.UUID {
+			if u.DeletedAt != nil || isBlocked(viewer.UUID, u.UUID) || u.checkStanding(ctx) != nil {
+				return ctx.NoContent(http.StatusNotFound)
+			}
+
+			go recordProfileView(viewer, u.UUID)
+		}
+
+		return ctx.JSON(http.StatusOK, p.project(viewer))
+	}
+
 	return ctx.JSON(http.StatusOK, item)
 }
 
@@ -65,6 +80,11 @@ func apiBulkReadHandler(ctx echo.Context) error {
 		err   error
 	)
 
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
 	item, err := getAPIItem(ctx)
 	if err != nil {
 		return ctx.JSON(http.StatusBadRequest, err.Error())
@@ -76,7 +96,7 @@ func apiBulkReadHandler(ctx echo.Context) error {
 		return returnInvalidData(ctx, err)
 	}
 
-	items, err := item.bulkRead(uuids)
+	items, err := item.bulkRead(u, uuids)
 	if err != nil {
 		return ctx.NoContent(http.StatusNotFound)
 	}
@@ -89,8 +109,6 @@ func apiSearchHandler(ctx echo.Context) error {
 	u, err := verifySession(ctx)
 	if err != nil {
 		return ctx.JSON(http.StatusUnauthorized, err.Error())
-	} else {
-		LoggedInUser = u
 	}
 
 	var params SearchQuery
@@ -110,7 +128,7 @@ func apiSearchHandler(ctx echo.Context) error {
 		params.Limit = 10
 	}
 
-	items, err := item.doSearch(params)
+	items, err := item.doSearch(u, params)
 	if err != nil {
 		return ctx.NoContent(http.StatusNotFound)
 	}
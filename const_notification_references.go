@@ -9,4 +9,24 @@ const (
 	PersonLoginReminder uint = 1
 	PersonInterested    uint = 2
 	PersonVisited       uint = 3
+
+	PersonInterestAccepted  uint = 4
+	PersonInterestDeclined  uint = 5
+	PersonInterestWithdrawn uint = 6
+	PersonInterestExpired   uint = 7
+
+	AccountWarned  uint = 8
+	ReportResolved uint = 9
+
+	NewMessage uint = 10
+
+	MembershipExpiring uint = 11
+	MembershipExpired  uint = 12
+
+	ReferralRewardPosted uint = 13
+
+	PhotoRejected uint = 14
+
+	BadgeGranted         uint = 15
+	VerificationDeclined uint = 16
 )
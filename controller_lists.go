@@ -12,6 +12,26 @@ type ListsResponse struct {
 	AssetTypes ListItems `json:"asset_types"`
 	Config     ListItems `json:"config"`
 	States     ListItems `json:"states"`
+
+	PrivacyLevels ListItems `json:"privacy_levels"`
+	ReportReasons ListItems `json:"report_reasons"`
+
+	FamilyTypes          ListItems `json:"family_types"`
+	ProfessionCategories ListItems `json:"profession_categories"`
+	EmploymentTypes      ListItems `json:"employment_types"`
+
+	Complexions      ListItems `json:"complexions"`
+	Diets            ListItems `json:"diets"`
+	HabitFrequencies ListItems `json:"habit_frequencies"` // smoking and drinking
+	MotherTongues    ListItems `json:"mother_tongues"`
+	Disabilities     ListItems `json:"disabilities"`
+
+	// Managed by admins, translated to the request language
+	Religions   []MasterListItem `json:"religions"`
+	Castes      []MasterListItem `json:"castes"`
+	SubCastes   []MasterListItem `json:"sub_castes"`
+	Educations  []MasterListItem `json:"educations"`
+	Professions []MasterListItem `json:"professions"`
 }
 
 func listAPIHandler(ctx echo.Context) error {
@@ -23,6 +43,21 @@ func listAPIHandler(ctx echo.Context) error {
 	// resp.AssetTypes = GetAssetTypes()
 	resp.Config = getConfigVars()
 	resp.States = getStates()
+	resp.PrivacyLevels = getPrivacyLevels()
+	resp.ReportReasons = getReportReasons()
+	resp.FamilyTypes = getFamilyTypes()
+	resp.ProfessionCategories = getProfessionCategories()
+	resp.EmploymentTypes = getEmploymentTypes()
+	resp.Complexions = getComplexions()
+	resp.Diets = getDiets()
+	resp.HabitFrequencies = getHabitFrequencies()
+	resp.MotherTongues = getMotherTongues()
+	resp.Disabilities = getDisabilities()
+	resp.Religions = getMasterList(ctx, MasterReligion)
+	resp.Castes = getMasterList(ctx, MasterCaste)
+	resp.SubCastes = getMasterList(ctx, MasterSubCaste)
+	resp.Educations = getMasterList(ctx, MasterEducation)
+	resp.Professions = getMasterList(ctx, MasterProfession)
 
 	return ctx.JSON(http.StatusOK, resp)
 }
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func adminReportsHandler(ctx echo.Context) error {
+	type moderationItem struct {
+		UserReport
+		Reporter     User `json:"reporter"`
+		Reported     User `json:"reported"`
+		PriorReports int  `json:"prior_reports"`
+	}
+
+	var rr []UserReport
+
+	status := ctx.QueryParam("status")
+	if status == "" {
+		status = ReportOpen
+	}
+
+	page, err := strconv.Atoi(ctx.QueryParam("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit := 50
+
+	db.Where("status = ?", status).Order("id ASC").Limit(limit).Offset(limit * (page - 1)).Find(&rr)
+
+	uuids := make([]string, 0, len(rr)*2)
+	for _, r := range rr {
+		uuids = append(uuids, r.ReporterUUID, r.ReportedUUID)
+	}
+
+	var uu []User
+	db.Unscoped().Where("uuid IN (?)", getUnique(uuids)).Find(&uu)
+
+	users := make(map[string]User, len(uu))
+	for _, u := range uu {
+		users[u.UUID] = u
+	}
+
+	var counts []struct {
+		ReportedUUID string
+		Count        int
+	}
+	db.Model(&UserReport{}).Select("reported_uuid, COUNT(id) count").Where("reported_uuid IN (?)", getUnique(uuids)).Group("reported_uuid").Scan(&counts)
+
+	prior := make(map[string]int, len(counts))
+	for _, c := range counts {
+		prior[c.ReportedUUID] = c.Count
+	}
+
+	items := make([]moderationItem, 0, len(rr))
+	for _, r := range rr {
+		items = append(items, moderationItem{
+			UserReport:   r,
+			Reporter:     users[r.ReporterUUID],
+			Reported:     users[r.ReportedUUID],
+			PriorReports: prior[r.ReportedUUID] - 1,
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, items)
+}
+
+func adminTriageReportHandler(ctx echo.Context) error {
+	var (
+		r    UserReport
+		data struct {
+			Status string `json:"status"`
+		}
+	)
+
+	err := ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	if !isOneOf(data.Status, []string{ReportOpen, ReportInReview}) {
+		return ctx.JSON(http.StatusBadRequest, "Status is invalid")
+	}
+
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&r).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if r.ResolvedAt.Valid {
+		return ctx.JSON(http.StatusConflict, "Report has already been resolved")
+	}
+
+	db.Model(&r).Updates(map[string]interface{}{"status": data.Status})
+
+	return ctx.JSON(http.StatusOK, r)
+}
+
+func adminModerateReportHandler(ctx echo.Context) error {
+	var (
+		r        UserReport
+		reported User
+		data     struct {
+			Action      string `json:"action"`
+			Note        string `json:"note"`
+			SuspendDays int    `json:"suspend_days"`
+		}
+	)
+
+	err := ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	if !isOneOf(data.Action, getModerationActions()) {
+		return ctx.JSON(http.StatusBadRequest, "Action is invalid")
+	}
+
+	if data.Action == ModerationSuspend && data.SuspendDays <= 0 {
+		return ctx.JSON(http.StatusBadRequest, "Suspension days are required")
+	}
+
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&r).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if r.ResolvedAt.Valid {
+		return ctx.JSON(http.StatusConflict, "Report has already been resolved")
+	}
+
+	if db.Unscoped().Where("uuid = ?", r.ReportedUUID).First(&reported).RecordNotFound() {
+		return ctx.JSON(http.StatusNotFound, "User not found")
+	}
+
+	tx := db.Begin()
+
+	switch data.Action {
+	case ModerationSuspend:
+		err = tx.Model(&reported).Updates(map[string]interface{}{"suspended_until": time.Now().AddDate(0, 0, data.SuspendDays)}).Error
+	case ModerationBan:
+		err = tx.Model(&reported).Updates(map[string]interface{}{"banned_at": time.Now()}).Error
+		if err == nil {
+			err = tx.Where("user_id = ?", reported.ID).Delete(&Session{}).Error
+		}
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return ctx.JSON(http.StatusInternalServerError, "Unable to apply action")
+	}
+
+	status := ReportActioned
+	if data.Action == ModerationDismiss {
+		status = ReportDismissed
+	}
+
+	err = tx.Model(&r).Updates(map[string]interface{}{
+		"status":         status,
+		"action":         data.Action,
+		"moderator_note": sanitizeText(data.Note, 2000),
+		"resolved_at":    time.Now(),
+	}).Error
+	if err != nil {
+		tx.Rollback()
+		return ctx.JSON(http.StatusInternalServerError, "Unable to save report")
+	}
+
+	tx.Commit()
+
+	if data.Action == ModerationWarn {
+		w := Notification{ReceiverID: r.ReportedUUID, ReferenceID: AccountWarned}
+		go w.createAndSend()
+	}
+
+	n := Notification{ReceiverID: r.ReporterUUID, ReferenceID: ReportResolved}
+	go n.createAndSend()
+
+	return ctx.JSON(http.StatusOK, r)
+}
+
+func adminFlaggedMessagesHandler(ctx echo.Context) error {
+	type flaggedMessage struct {
+		Message
+		FlagReason string `json:"flag_reason"`
+		Sender     User   `json:"sender"`
+	}
+
+	var mm []Message
+
+	db.Where("flagged = ?", true).Order("id ASC").Limit(100).Find(&mm)
+
+	uuids := make([]string, 0, len(mm))
+	for _, m := range mm {
+		uuids = append(uuids, m.SenderUUID)
+	}
+
+	var uu []User
+	db.Unscoped().Where("uuid IN (?)", getUnique(uuids)).Find(&uu)
+
+	users := make(map[string]User, len(uu))
+	for _, u := range uu {
+		users[u.UUID] = u
+	}
+
+	items := make([]flaggedMessage, 0, len(mm))
+	for _, m := range mm {
+		items = append(items, flaggedMessage{Message: m, FlagReason: m.FlagReason, Sender: users[m.SenderUUID]})
+	}
+
+	return ctx.JSON(http.StatusOK, items)
+}
+
+func adminReviewMessageHandler(ctx echo.Context) error {
+	var (
+		m    Message
+		data struct {
+			Action string `json:"action"`
+		}
+	)
+
+	err := ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&m).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	switch data.Action {
+	case "clear":
+		err = db.Model(&m).Updates(map[string]interface{}{"flagged": false}).Error
+	case "remove":
+		err = db.Delete(&m).Error
+	default:
+		return ctx.JSON(http.StatusBadRequest, "Action is invalid")
+	}
+
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, "Unable to review message")
+	}
+
+	return ctx.NoContent(http.StatusOK)
+}
+
+func adminMediaHandler(ctx echo.Context) error {
+	type moderationMedia struct {
+		Media
+		Owner User `json:"owner"`
+	}
+
+	var mm []Media
+
+	status := ctx.QueryParam("status")
+	if status == "" {
+		status = MediaPending
+	}
+
+	page, err := strconv.Atoi(ctx.QueryParam("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit := 50
+
+	db.Where("status = ?", status).Order("updated_at ASC").Limit(limit).Offset(limit * (page - 1)).Find(&mm)
+
+	uuids := make([]string, 0, len(mm))
+	for _, m := range mm {
+		uuids = append(uuids, m.UserUUID)
+	}
+
+	var uu []User
+	db.Unscoped().Where("uuid IN (?)", getUnique(uuids)).Find(&uu)
+
+	users := make(map[string]User, len(uu))
+	for _, u := range uu {
+		users[u.UUID] = u
+	}
+
+	items := make([]moderationMedia, 0, len(mm))
+	for _, m := range mm {
+		items = append(items, moderationMedia{Media: m, Owner: users[m.UserUUID]})
+	}
+
+	return ctx.JSON(http.StatusOK, items)
+}
+
+func adminReviewMediaHandler(ctx echo.Context) error {
+	var data struct {
+		Items []struct {
+			UUID   string `json:"uuid"`
+			Action string `json:"action"`
+			Reason string `json:"reason"`
+		} `json:"items"`
+	}
+
+	err := ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	if len(data.Items) == 0 || len(data.Items) > 100 {
+		return ctx.JSON(http.StatusBadRequest, "Between 1 and 100 items are required")
+	}
+
+	for _, item := range data.Items {
+		if !isOneOf(item.Action, []string{"approve", "reject"}) {
+			return ctx.JSON(http.StatusBadRequest, "Action is invalid")
+		}
+
+		if item.Action == "reject" && strings.TrimSpace(item.Reason) == "" {
+			return ctx.JSON(http.StatusBadRequest, "Reason is required to reject a photo")
+		}
+	}
+
+	actor := getAdminActor(ctx)
+	reviewed := make([]string, 0, len(data.Items))
+
+	for _, item := range data.Items {
+		var m Media
+
+		if db.Where("uuid = ?", item.UUID).First(&m).RecordNotFound() {
+			continue
+		}
+
+		updates := map[string]interface{}{
+			"status":           MediaApproved,
+			"rejection_reason": "",
+			"moderated_by":     actor,
+			"moderated_at":     time.Now(),
+		}
+
+		if item.Action == "reject" {
+			updates["status"] = MediaRejected
+			updates["rejection_reason"] = sanitizeText(item.Reason, 500)
+		}
+
+		err = db.Model(&Media{}).Where("id = ?", m.ID).Updates(updates).Error
+		if err != nil {
+			continue
+		}
+
+		reviewed = append(reviewed, m.UUID)
+
+		// The selfie badge vouched for this photo
+		if item.Action == "reject" && m.IsPrimary {
+			revokeBadge(m.UserUUID, BadgePhoto)
+		}
+
+		if item.Action == "reject" && m.Status != MediaRejected {
+			n := Notification{ReceiverID: m.UserUUID, ReferenceID: PhotoRejected}
+			go n.createAndSend()
+		}
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{"reviewed": reviewed})
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func adminPaymentsHandler(ctx echo.Context) error {
+	type paymentItem struct {
+		Payment
+		Refunds       []Refund `json:"refunds"`
+		InvoiceNumber string   `json:"invoice_number"`
+	}
+
+	var pp []Payment
+
+	page, err := strconv.Atoi(ctx.QueryParam("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit := 50
+
+	dbQuery := db.Model(&Payment{})
+
+	if v := ctx.QueryParam("user_uuid"); v != "" {
+		dbQuery = dbQuery.Where("user_uuid = ?", v)
+	}
+
+	if v := ctx.QueryParam("transaction_id"); v != "" {
+		dbQuery = dbQuery.Where("transaction_id = ?", v)
+	}
+
+	if v := ctx.QueryParam("status"); v != "" {
+		dbQuery = dbQuery.Where("status = ?", v)
+	}
+
+	if v := ctx.QueryParam("from"); v != "" {
+		from, err := time.ParseInLocation("2006-01-02", v, indiaTimezone)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, gettext("Invalid date", ctx))
+		}
+
+		dbQuery = dbQuery.Where("created_at >= ?", from)
+	}
+
+	if v := ctx.QueryParam("to"); v != "" {
+		to, err := time.ParseInLocation("2006-01-02", v, indiaTimezone)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, gettext("Invalid date", ctx))
+		}
+
+		dbQuery = dbQuery.Where("created_at < ?", to.AddDate(0, 0, 1))
+	}
+
+	dbQuery.Order("id DESC").Limit(limit).Offset(limit * (page - 1)).Find(&pp)
+
+	ids := make([]uint, 0, len(pp))
+	for _, p := range pp {
+		ids = append(ids, p.ID)
+	}
+
+	var rr []Refund
+	db.Where("payment_id IN (?)", ids).Order("id ASC").Find(&rr)
+
+	var ii []Invoice
+	db.Where("payment_id IN (?)", ids).Find(&ii)
+
+	items := make([]paymentItem, 0, len(pp))
+	for _, p := range pp {
+		item := paymentItem{Payment: p, Refunds: []Refund{}}
+
+		for _, r := range rr {
+			if r.PaymentID == p.ID {
+				item.Refunds = append(item.Refunds, r)
+			}
+		}
+
+		for _, i := range ii {
+			if i.PaymentID == p.ID {
+				item.InvoiceNumber = i.Number
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	return ctx.JSON(http.StatusOK, items)
+}
+
+// adminRefundPaymentHandler refunds a payment. Without an amount whatever has
+// not been refunded yet is returned.
+func adminRefundPaymentHandler(ctx echo.Context) error {
+	var (
+		p    Payment
+		data struct {
+			Amount float64 `json:"amount"`
+			Reason string  `json:"reason"`
+		}
+	)
+
+	err := ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	data.Reason = sanitizeText(data.Reason, 500)
+	if data.Reason == "" {
+		return ctx.JSON(http.StatusBadRequest, gettext("Reason is required", ctx))
+	}
+
+	if db.Where("transaction_id = ?", ctx.Param("transaction_id")).First(&p).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if data.Amount == 0 {
+		data.Amount = roundAmount(p.Amount - getRefundedAmount(db, p.ID))
+	}
+
+	r, err := issueRefund(p, data.Amount, data.Reason, getAdminActor(ctx))
+	if err == errInsufficientBalance {
+		return ctx.JSON(http.StatusConflict, gettext("The member has already spent these credits", ctx))
+	}
+
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	recordAudit(ctx, AuditLog{Action: AuditRefund, UserUUID: p.UserUUID, PaymentID: p.ID, Amount: r.Amount, Reason: data.Reason}, map[string]string{
+		"transaction_id": p.TransactionID,
+		"refund_id":      r.RefundID,
+		"status":         r.Status,
+	})
+
+	return ctx.JSON(http.StatusCreated, r)
+}
+
+// adminCreditWalletHandler grants goodwill credits to a member.
+func adminCreditWalletHandler(ctx echo.Context) error {
+	var (
+		u    User
+		data struct {
+			Amount float64 `json:"amount"`
+			Reason string  `json:"reason"`
+		}
+	)
+
+	err := ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	data.Reason = sanitizeText(data.Reason, 500)
+	if strings.TrimSpace(data.Reason) == "" {
+		return ctx.JSON(http.StatusBadRequest, gettext("Reason is required", ctx))
+	}
+
+	_, max := getPaymentAmountLimits()
+	if data.Amount <= 0 || data.Amount > max {
+		return ctx.JSON(http.StatusBadRequest, gettext("Invalid amount", ctx))
+	}
+
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&u).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	id, err := generateRandomString(16)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to credit wallet", ctx))
+	}
+
+	e, err := postWalletTransaction(u.UUID, LedgerBonus, data.Amount, "goodwill:"+id, data.Reason)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to credit wallet", ctx))
+	}
+
+	recordAudit(ctx, AuditLog{Action: AuditGoodwillCredit, UserUUID: u.UUID, Amount: e.Amount, Reason: data.Reason}, map[string]string{
+		"transaction_id": e.TransactionID,
+	})
+
+	return ctx.JSON(http.StatusCreated, e)
+}
+
+func adminAuditLogsHandler(ctx echo.Context) error {
+	var aa []AuditLog
+
+	page, err := strconv.Atoi(ctx.QueryParam("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit := 50
+
+	dbQuery := db.Model(&AuditLog{})
+
+	if v := ctx.QueryParam("user_uuid"); v != "" {
+		dbQuery = dbQuery.Where("user_uuid = ?", v)
+	}
+
+	if v := ctx.QueryParam("action"); v != "" {
+		dbQuery = dbQuery.Where("action = ?", v)
+	}
+
+	dbQuery.Order("id DESC").Limit(limit).Offset(limit * (page - 1)).Find(&aa)
+
+	return ctx.JSON(http.StatusOK, aa)
+}
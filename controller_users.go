@@ -18,7 +18,8 @@ func userGetHandler(ctx echo.Context) error {
 		return ctx.JSON(http.StatusUnauthorized, err.Error())
 	}
 
-	db.Model(&Media{}).Where("user_uuid = ?", u.UUID).Find(&u.UserMedia)
+	db.Model(&Media{}).Where("user_uuid = ?", u.UUID).Order("is_primary DESC, position ASC, id ASC").Find(&u.UserMedia)
+	u.Badges = getBadges([]string{u.UUID})[u.UUID]
 	return ctx.JSON(http.StatusOK, u)
 }
 
@@ -51,6 +52,7 @@ func userRegisterHandler(ctx echo.Context) error {
 			Host         string `json:"host"`
 			CurrentPath  string `json:"current_path"`
 			RedirectPath string `json:"redirect_path"`
+			ReferralCode string `json:"referral_code"`
 		}
 		u User
 	)
@@ -90,7 +92,6 @@ func userRegisterHandler(ctx echo.Context) error {
 		}
 	}
 
-	u.IsVerified = true
 	u.Consented = true
 	u.ConsentedDate.Valid = true
 	u.ConsentedDate.Time = time.Now()
@@ -124,6 +125,8 @@ func userRegisterHandler(ctx echo.Context) error {
 
 	tx.Commit()
 
+	attributeReferral(u.UUID, data.ReferralCode)
+
 	// vars := make(map[string]string)
 	// if len(u.Email) > 0 {
 	// 	vars["user_email"] = string(u.Email)
@@ -180,6 +183,7 @@ func userUpdateHandler(ctx echo.Context) error {
 
 	new = data.User
 	new.ID = old.ID
+	new.applyLegacyEducationalInfo(old.EducationalInfo)
 
 	if !new.Consented {
 		new.Consented = true
@@ -199,29 +203,36 @@ func userUpdateHandler(ctx echo.Context) error {
 
 	tx.Commit()
 
+	revokeChangedContactBadges(old.UUID, old, new)
+
 	return ctx.JSON(http.StatusOK, new)
 }
 
 func userAdminUpdateHandler(ctx echo.Context) error {
 	var (
 		data struct {
-			FirstName        string          `json:"first_name"`
-			LastName         string          `json:"last_name"`
-			Email            string          `json:"email"`
-			Phone            string          `json:"phone"`
-			SubCaste         interface{}     `json:"sub_caste"`
-			Address1         string          `json:"address_1"`
-			Address2         string          `json:"address_2"`
-			City             string          `json:"city"`
-			State            string          `json:"state"`
-			Country          string          `json:"country"`
-			DateOfBirth      string          `json:"date_of_birth"`
-			Gender           interface{}     `json:"gender"`
-			MaritalStatus    interface{}     `json:"marital_status"`
-			OrganizationName string          `json:"organization_name"`
-			Industry         string          `json:"industry"`
-			EducationalInfo  json.RawMessage `json:"educationl_info"`
-			UUID             string          `json:"uuid"`
+			FirstName        string           `json:"first_name"`
+			LastName         string           `json:"last_name"`
+			Email            string           `json:"email"`
+			Phone            string           `json:"phone"`
+			SubCaste         interface{}      `json:"sub_caste"`
+			Address1         string           `json:"address_1"`
+			Address2         string           `json:"address_2"`
+			City             string           `json:"city"`
+			State            string           `json:"state"`
+			Country          string           `json:"country"`
+			DateOfBirth      string           `json:"date_of_birth"`
+			Gender           interface{}      `json:"gender"`
+			MaritalStatus    interface{}      `json:"marital_status"`
+			OrganizationName string           `json:"organization_name"`
+			Industry         string           `json:"industry"`
+			FamilyInfo       *FamilyInfo      `json:"family_info"`
+			EducationalInfo  *EducationalInfo `json:"educational_info"`
+			CareerInfo       *CareerInfo      `json:"career_info"`
+			UUID             string           `json:"uuid"`
+
+			// Older admin clients send educational info under a misspelt key
+			LegacyEducationalInfo *EducationalInfo `json:"educationl_info"`
 		}
 	)
 	err := ctx.Bind(&data)
@@ -229,10 +240,73 @@ func userAdminUpdateHandler(ctx echo.Context) error {
 		return returnInvalidData(ctx, err)
 	}
 
+	if data.EducationalInfo == nil {
+		data.EducationalInfo = data.LegacyEducationalInfo
+	}
+
+	if subCaste, ok := data.SubCaste.(string); ok {
+		resolved, valid := resolveMasterValue(MasterSubCaste, subCaste, "")
+		if !valid {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Sub-caste is invalid"})
+		}
+
+		data.SubCaste = resolved
+	}
+
+	info := map[string]interface{}{}
+
+	if data.FamilyInfo != nil {
+		data.FamilyInfo.sanitize()
+
+		err = data.FamilyInfo.validate(ctx)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		info["family_info"] = *data.FamilyInfo
+	}
+
+	if data.EducationalInfo != nil {
+		data.EducationalInfo.sanitize()
+
+		err = data.EducationalInfo.validate(ctx)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		education, valid := resolveMasterValue(MasterEducation, data.EducationalInfo.Education, "")
+		if !valid {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Education is invalid"})
+		}
+
+		data.EducationalInfo.Education = education
+		info["educational_info"] = *data.EducationalInfo
+	}
+
+	if data.CareerInfo != nil {
+		data.CareerInfo.sanitize()
+
+		err = data.CareerInfo.validate(ctx)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+
+		profession, valid := resolveMasterValue(MasterProfession, data.CareerInfo.Profession, "")
+		if !valid {
+			return ctx.JSON(http.StatusBadRequest, map[string]string{"error": "Profession is invalid"})
+		}
+
+		data.CareerInfo.Profession = profession
+		info["career_info"] = *data.CareerInfo
+	}
+
 	if data.UUID == "" {
 		return ctx.JSON(http.StatusUnprocessableEntity, map[string]string{"error": "Missing required field: uuid"})
 	}
 
+	var old User
+	db.Select("uuid, phone, email").Where("uuid = ?", data.UUID).First(&old)
+
 	// Start a transaction
 	tx := db.Begin()
 	if tx.Error != nil {
@@ -272,7 +346,21 @@ func userAdminUpdateHandler(ctx echo.Context) error {
 		tx.Rollback()
 		return ctx.JSON(http.StatusNotFound, map[string]string{"error": "User not found."})
 	}
+
+	// --- 2. Update the profile details sent ---
+	if len(info) > 0 {
+		err = tx.Model(&User{}).Where("uuid = ?", data.UUID).UpdateColumns(info).Error
+		if err != nil {
+			tx.Rollback()
+			ctx.Logger().Errorf("Error updating profile details: %v", err)
+			return ctx.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update profile data."})
+		}
+	}
+
 	tx.Commit()
+
+	revokeChangedContactBadges(data.UUID, old, User{Phone: data.Phone, Email: Email(data.Email)})
+
 	return ctx.JSON(http.StatusOK, data)
 
 }
@@ -307,6 +395,7 @@ func userPatchHandler(ctx echo.Context) error {
 	}
 
 	new = data.User
+	new.applyLegacyEducationalInfo(old.EducationalInfo)
 
 	if !new.Consented {
 		new.Consented = true
@@ -326,17 +415,18 @@ func userPatchHandler(ctx echo.Context) error {
 
 	tx.Commit()
 
+	revokeChangedContactBadges(old.UUID, old, new)
+
 	return ctx.JSON(http.StatusOK, new)
 }
 
+// userVerifyHandler approves the member's pending ID verification. A member
+// is only marked verified on the evidence of a reviewed document, so that
+// is_verified and the ID badge always agree.
 func userVerifyHandler(ctx echo.Context) error {
 	var (
-		u   User
-		err error
-		// data struct {
-		// 	Email string `json:"email"`
-		// 	Token string `json:"token"`
-		// }
+		v    Verification
+		err  error
 		data struct {
 			Uuid string `json:"uuid"`
 		}
@@ -348,26 +438,19 @@ func userVerifyHandler(ctx echo.Context) error {
 		return returnInvalidData(ctx, err)
 	}
 
-	// if db.Where("email ILIKE ?", data.Email).First(&u).RecordNotFound() {
-	// 	return ctx.JSON(http.StatusBadRequest, gettext("User not found", ctx))
-	// }
-
-	if u.IsVerified {
-		return ctx.JSON(http.StatusOK, gettext("You have already verified this user", ctx))
+	if db.Where("user_uuid = ? AND kind = ? AND status = ?", data.Uuid, VerificationKindID, VerificationPending).Order("id DESC").First(&v).RecordNotFound() {
+		return ctx.JSON(http.StatusConflict, "User has no pending ID verification to approve")
 	}
 
-	// err = bcrypt.CompareHashAndPassword([]byte(u.VerificationHash), []byte(data.Token))
-	// if err != nil {
-
-	// 	return ctx.JSON(http.StatusBadRequest, gettext("Verification token is invalid", ctx))
-	// }
+	err = reviewVerification(&v, "approve", "", getAdminActor(ctx))
+	if err == errVerificationReviewed {
+		return ctx.JSON(http.StatusConflict, err.Error())
+	}
 
-	// Start with db.Model(&User{}) to ensure a clean slate
-	result := db.Exec("UPDATE users SET is_verified = ? WHERE uuid = ?", true, data.Uuid)
-	if result.Error != nil {
-		// There was a database execution error.
-		return ctx.JSON(http.StatusInternalServerError, result.Error.Error())
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, "Unable to verify user")
 	}
+
 	return ctx.JSON(http.StatusOK, gettext("User has been verified", ctx))
 }
 
@@ -410,7 +493,10 @@ func userUnverifyHandler(ctx echo.Context) error {
 		// There was a database execution error.
 		return ctx.JSON(http.StatusInternalServerError, result.Error.Error())
 	}
-	return ctx.JSON(http.StatusOK, gettext("User has been verified", ctx))
+
+	revokeBadge(data.Uuid, BadgeID)
+
+	return ctx.JSON(http.StatusOK, gettext("User has been unverified", ctx))
 }
 
 func userSendVerifyHandler(ctx echo.Context) error {
@@ -443,7 +529,7 @@ func userSendVerifyHandler(ctx echo.Context) error {
 			return ctx.JSON(http.StatusBadRequest, gettext("Email not found", ctx))
 		}
 
-		if e.IsVerified {
+		if e.hasVerifiedEmail() {
 			return ctx.JSON(http.StatusOK, gettext("You have already verified this email address", ctx))
 		}
 
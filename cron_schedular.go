@@ -48,5 +48,16 @@ func setupCron() {
 func sequentialJobs() {
 	log.Print("Sequential jobs started at: ", time.Now().String)
 
+	expireInterests()
+	purgeEvents()
+	generateMissingRenditions()
+	purgeVerificationDocuments()
+	remindExpiringSubscriptions()
+	expireSubscriptions()
+	settlePendingPayments()
+	settleRefunds()
+	issueMissingInvoices()
+	reconcileWallets()
+
 	log.Print("Sequential jobs ended at: ", time.Now().String)
 }
@@ -14,14 +14,20 @@ type apiObject interface {
 	validate(echo.Context, bool) error
 	exists() bool
 	getExistsMessage(echo.Context) string
-	doSearch(SearchQuery) (interface{}, error)
-	bulkRead([]string) (interface{}, error)
+	doSearch(viewer User, params SearchQuery) (interface{}, error)
+	bulkRead(viewer User, keys []string) (interface{}, error)
 	restore(echo.Context, *gorm.DB) error
 
 	postRead()
 	postSearch()
 }
 
+// profileProjector is implemented by items that must be reduced to what the
+// viewer is allowed to see before they are returned.
+type profileProjector interface {
+	project(viewer User) interface{}
+}
+
 func getAPIItem(ctx echo.Context) (apiObject, error) {
 	var item apiObject
 
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// setupTestDB connects to the database in VM_TEST_DATABASE_URL and migrates
+// it. Tests that need a database are skipped without one. Never point it at
+// a database holding real data.
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	url := os.Getenv("VM_TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("VM_TEST_DATABASE_URL is not set")
+	}
+
+	if db != nil {
+		return
+	}
+
+	os.Setenv("DATABASE_URL", url)
+
+	err := openDatabaseConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.LogMode(false)
+
+	migrate()
+}
+
+// newTestUserUUID returns a member UUID no other test uses, so tests can
+// share the database.
+func newTestUserUUID() string {
+	return uuid.NewV4().String()
+}
+
+func getTestBalance(t *testing.T, userUUID string) float64 {
+	t.Helper()
+
+	var w Wallet
+
+	if db.Where("user_uuid = ?", userUUID).First(&w).RecordNotFound() {
+		return 0
+	}
+
+	return w.Balance
+}
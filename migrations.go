@@ -6,7 +6,26 @@ import (
 
 func migrate() {
 	db.AutoMigrate(&User{}, &Session{}, &UserInterest{}, &Media{}, &Payment{}, &Wallet{})
+	db.AutoMigrate(&LedgerEntry{}, &Plan{}, &Subscription{})
+	db.AutoMigrate(&Invoice{}, &InvoiceSequence{})
+	db.AutoMigrate(&Refund{}, &AuditLog{})
+	db.AutoMigrate(&ReferralCode{}, &Referral{}, &Coupon{}, &CouponRedemption{})
+	db.AutoMigrate(&ProfileView{}, &Shortlist{}, &ContactUnlock{})
+	db.AutoMigrate(&UserBlock{}, &UserReport{})
+	db.AutoMigrate(&UserBadge{}, &Verification{})
+	db.AutoMigrate(&MasterItem{})
+	db.AutoMigrate(&Conversation{}, &Message{}, &Event{})
 
 	db.AutoMigrate(&SMS{})
 	db.AutoMigrate(&Notification{})
+
+	migrateInterestStatuses()
+	migrateVisitedInterests()
+	migrateWalletLedger()
+	migrateMediaPaths()
+	migrateMediaStatuses()
+	migrateMediaTypes()
+	migrateProfileInfo()
+	migrateFamilyTypes()
+	seedMasterData()
 }
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	MinHeightCm = 120
+	MaxHeightCm = 230
+)
+
+// Attributes are the lifestyle and physical details families filter on.
+// Each is validated against the list served by listAPIHandler.
+type Attributes struct {
+	HeightCm     uint   `gorm:"index" json:"height_cm"`
+	Complexion   string `gorm:"index" json:"complexion"`
+	Diet         string `gorm:"index" json:"diet"`
+	Smoking      string `json:"smoking"`
+	Drinking     string `json:"drinking"`
+	MotherTongue string `gorm:"index" json:"mother_tongue"`
+	Religion     string `gorm:"index" json:"religion"`
+	Disability   string `json:"disability"`
+}
+
+func getComplexions() ListItems {
+	return createList(
+		[]string{"Very fair", "very_fair"},
+		[]string{"Fair", "fair"},
+		[]string{"Wheatish", "wheatish"},
+		[]string{"Wheatish brown", "wheatish_brown"},
+		[]string{"Dark", "dark"},
+	)
+}
+
+func getDiets() ListItems {
+	return createList(
+		[]string{"Vegetarian", "veg"},
+		[]string{"Non-vegetarian", "non_veg"},
+		[]string{"Eggetarian", "eggetarian"},
+		[]string{"Jain", "jain"},
+		[]string{"Vegan", "vegan"},
+	)
+}
+
+// getHabitFrequencies is used for both smoking and drinking.
+func getHabitFrequencies() ListItems {
+	return createList(
+		[]string{"No", "no"},
+		[]string{"Occasionally", "occasionally"},
+		[]string{"Yes", "yes"},
+	)
+}
+
+func getMotherTongues() ListItems {
+	return createList(
+		[]string{"Marathi", "marathi"},
+		[]string{"Hindi", "hindi"},
+		[]string{"Gujarati", "gujarati"},
+		[]string{"Konkani", "konkani"},
+		[]string{"Kannada", "kannada"},
+		[]string{"Telugu", "telugu"},
+		[]string{"Tamil", "tamil"},
+		[]string{"Malayalam", "malayalam"},
+		[]string{"Bengali", "bengali"},
+		[]string{"Punjabi", "punjabi"},
+		[]string{"Urdu", "urdu"},
+		[]string{"Sindhi", "sindhi"},
+		[]string{"English", "english"},
+		[]string{"Other", "other"},
+	)
+}
+
+func getDisabilities() ListItems {
+	return createList(
+		[]string{"None", "none"},
+		[]string{"Physical", "physical"},
+		[]string{"Visual", "visual"},
+		[]string{"Hearing", "hearing"},
+		[]string{"Speech", "speech"},
+		[]string{"Other", "other"},
+	)
+}
+
+func (a *Attributes) validate(ctx echo.Context) error {
+	if a.HeightCm != 0 && (a.HeightCm < MinHeightCm || a.HeightCm > MaxHeightCm) {
+		return errors.New(gettext("Height is invalid", ctx))
+	}
+
+	checks := []struct {
+		value   string
+		list    ListItems
+		message string
+	}{
+		{a.Complexion, getComplexions(), "Complexion is invalid"},
+		{a.Diet, getDiets(), "Diet is invalid"},
+		{a.Smoking, getHabitFrequencies(), "Smoking habit is invalid"},
+		{a.Drinking, getHabitFrequencies(), "Drinking habit is invalid"},
+		{a.MotherTongue, getMotherTongues(), "Mother tongue is invalid"},
+		{a.Disability, getDisabilities(), "Disability is invalid"},
+	}
+
+	for _, c := range checks {
+		if c.value != "" && !c.list.Contains(c.value) {
+			return errors.New(gettext(c.message, ctx))
+		}
+	}
+
+	return nil
+}
+
+// validateMultiSelect checks every value of a search filter is in the list.
+func validateMultiSelect(ctx echo.Context, values []string, list ListItems, message string) error {
+	for _, v := range values {
+		if !list.Contains(v) {
+			return errors.New(gettext(message, ctx))
+		}
+	}
+
+	return nil
+}
+
+// sanitizePartnerPreferences keeps only the filters of a search a member can
+// save as partner preferences.
+func (sq *SearchQuery) sanitizePartnerPreferences() {
+	sq.Query = ""
+	sq.Order = ""
+	sq.OrderBy = ""
+	sq.Page = 0
+	sq.Limit = 0
+	sq.UserUUID = nil
+
+	sq.resolveMasterFilters()
+}
+
+// resolveMasterFilters maps the master data filters of a search to codes.
+func (sq *SearchQuery) resolveMasterFilters() {
+	sq.Religions = resolveMasterValues(MasterReligion, sq.Religions)
+	sq.Caste, _ = resolveMasterValue(MasterCaste, sq.Caste, "")
+	sq.SubCastes = resolveMasterValues(MasterSubCaste, sq.SubCastes)
+	sq.Educations = resolveMasterValues(MasterEducation, sq.Educations)
+	sq.Professions = resolveMasterValues(MasterProfession, sq.Professions)
+}
+
+func (sq *SearchQuery) validate(ctx echo.Context) error {
+	if sq.HeightFrom != 0 && (sq.HeightFrom < MinHeightCm || sq.HeightFrom > MaxHeightCm) ||
+		sq.HeightTo != 0 && (sq.HeightTo < MinHeightCm || sq.HeightTo > MaxHeightCm) ||
+		sq.HeightFrom != 0 && sq.HeightTo != 0 && sq.HeightFrom > sq.HeightTo {
+		return errors.New(gettext("Height range is invalid", ctx))
+	}
+
+	checks := []struct {
+		values  []string
+		list    ListItems
+		message string
+	}{
+		{sq.Complexions, getComplexions(), "Complexion is invalid"},
+		{sq.Diets, getDiets(), "Diet is invalid"},
+		{sq.Smoking, getHabitFrequencies(), "Smoking habit is invalid"},
+		{sq.Drinking, getHabitFrequencies(), "Drinking habit is invalid"},
+		{sq.MotherTongues, getMotherTongues(), "Mother tongue is invalid"},
+		{sq.Disabilities, getDisabilities(), "Disability is invalid"},
+		{sq.FamilyTypes, getFamilyTypes(), "Family type is invalid"},
+		{sq.ProfessionCategories, getProfessionCategories(), "Profession category is invalid"},
+		{sq.EmploymentTypes, getEmploymentTypes(), "Employment type is invalid"},
+	}
+
+	for _, c := range checks {
+		err := validateMultiSelect(ctx, c.values, c.list, c.message)
+		if err != nil {
+			return err
+		}
+	}
+
+	masterChecks := []struct {
+		kind    string
+		values  []string
+		message string
+	}{
+		{MasterReligion, sq.Religions, "Religion is invalid"},
+		{MasterCaste, []string{sq.Caste}, "Caste is invalid"},
+		{MasterSubCaste, sq.SubCastes, "Sub-caste is invalid"},
+		{MasterEducation, sq.Educations, "Education is invalid"},
+		{MasterProfession, sq.Professions, "Profession is invalid"},
+	}
+
+	for _, c := range masterChecks {
+		for _, v := range c.values {
+			if _, ok := resolveMasterValue(c.kind, v, ""); !ok {
+				return errors.New(gettext(c.message, ctx))
+			}
+		}
+	}
+
+	return nil
+}
+
+func partnerPreferences(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	return ctx.JSON(http.StatusOK, u.PartnerPreferences)
+}
+
+func savePartnerPreferences(ctx echo.Context) error {
+	var sq SearchQuery
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = ctx.Bind(&sq)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	sq.sanitizePartnerPreferences()
+
+	err = sq.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	err = db.Model(&User{}).Where("id = ?", u.ID).UpdateColumn("partner_preferences", sq).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to save partner preferences", ctx))
+	}
+
+	return ctx.JSON(http.StatusOK, sq)
+}
+
+// recommendations searches with the member's partner preferences.
+func recommendations(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	params := u.PartnerPreferences
+	params.Page = 1
+
+	if page, err := strconv.Atoi(ctx.QueryParam("page")); err == nil && page > 1 {
+		params.Page = uint(page)
+	}
+
+	cards, err := u.doSearch(u, params)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, err.Error())
+	}
+
+	return ctx.JSON(http.StatusOK, cards)
+}
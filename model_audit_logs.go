@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	AuditRefund         = "refund"
+	AuditGoodwillCredit = "goodwill_credit"
+)
+
+// AuditLog records who moved money on behalf of a member and why. Rows are
+// only ever inserted.
+type AuditLog struct {
+	Model
+
+	Actor     string  `gorm:"index" json:"actor"`
+	Action    string  `gorm:"index" json:"action"`
+	UserUUID  string  `gorm:"type:uuid;index" json:"user_uuid"`
+	PaymentID uint    `gorm:"index" json:"-"`
+	Amount    float64 `json:"amount"`
+	Reason    string  `json:"reason"`
+	Details   string  `gorm:"type:jsonb" json:"details"`
+	IPAddress string  `json:"ip_address"`
+}
+
+// getAdminActor returns the basic auth user name of the admin making the
+// request.
+func getAdminActor(ctx echo.Context) string {
+	username, _, ok := ctx.Request().BasicAuth()
+	if !ok || username == "" {
+		return "admin"
+	}
+
+	return username
+}
+
+func recordAudit(ctx echo.Context, a AuditLog, details interface{}) {
+	a.Actor = getAdminActor(ctx)
+	a.IPAddress = ctx.RealIP()
+	a.Details = "{}"
+
+	if details != nil {
+		b, err := json.Marshal(details)
+		if err == nil {
+			a.Details = string(b)
+		}
+	}
+
+	err := db.Create(&a).Error
+	if err != nil {
+		log.Println("Error while saving audit log: ", err.Error())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	BadgePhone = "phone"
+	BadgeEmail = "email"
+	BadgeID    = "id"
+	BadgePhoto = "photo"
+)
+
+// UserBadge is shown on a member's profile once they have proven something
+// about themselves.
+type UserBadge struct {
+	ID             uint      `gorm:"primary_key" json:"-"`
+	UserUUID       string    `gorm:"type:uuid;unique_index:idx_user_badges_type" json:"-"`
+	Type           string    `gorm:"unique_index:idx_user_badges_type" json:"type"`
+	VerificationID uint      `json:"-"`
+	GrantedBy      string    `json:"-"`
+	GrantedAt      time.Time `json:"granted_at"`
+}
+
+func getBadgeTypes() []string {
+	return []string{BadgePhone, BadgeEmail, BadgeID, BadgePhoto}
+}
+
+// grantBadge gives a member a badge, keeping the first grant when they
+// already have it.
+func grantBadge(userUUID string, badgeType string, verificationID uint, grantedBy string) {
+	err := db.Exec(`INSERT INTO user_badges (user_uuid, type, verification_id, granted_by, granted_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_uuid, type) DO NOTHING`, userUUID, badgeType, verificationID, grantedBy, time.Now()).Error
+	if err != nil {
+		log.Println("Error while granting badge: ", err.Error())
+	}
+}
+
+func hasBadge(userUUID string, badgeType string) bool {
+	var count int
+
+	db.Model(&UserBadge{}).Where("user_uuid = ? AND type = ?", userUUID, badgeType).Count(&count)
+
+	return count > 0
+}
+
+func revokeBadge(userUUID string, badgeType string) {
+	db.Where("user_uuid = ? AND type = ?", userUUID, badgeType).Delete(&UserBadge{})
+}
+
+// revokeChangedContactBadges drops the phone and email badges when the
+// value they vouched for has changed. The new value has to be verified
+// again.
+func revokeChangedContactBadges(userUUID string, old User, new User) {
+	if strings.TrimSpace(old.Phone) != strings.TrimSpace(new.Phone) {
+		revokeBadge(userUUID, BadgePhone)
+	}
+
+	if !strings.EqualFold(strings.TrimSpace(string(old.Email)), strings.TrimSpace(string(new.Email))) {
+		revokeBadge(userUUID, BadgeEmail)
+	}
+}
+
+// getBadges returns the badge types of each member, in a stable order.
+func getBadges(uuids []string) map[string][]string {
+	var bb []UserBadge
+
+	badges := make(map[string][]string, len(uuids))
+
+	if len(uuids) == 0 {
+		return badges
+	}
+
+	db.Where("user_uuid IN (?)", uuids).Order("type ASC").Find(&bb)
+
+	for _, b := range bb {
+		badges[b.UserUUID] = append(badges[b.UserUUID], b.Type)
+	}
+
+	return badges
+}
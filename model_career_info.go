@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	EmploymentPrivate    = "private"
+	EmploymentGovernment = "government"
+	EmploymentBusiness   = "business"
+	EmploymentSelf       = "self_employed"
+	EmploymentNone       = "not_working"
+)
+
+// CareerInfo describes what a member does for a living. The job title stays
+// on UserData.
+type CareerInfo struct {
+	ProfessionCategory string `json:"profession_category"`
+	Profession         string `json:"profession"` // master data code
+	EmploymentType     string `json:"employment_type"`
+	Employer           string `json:"employer"`
+}
+
+func getProfessionCategories() ListItems {
+	return createList(
+		[]string{"Engineering & IT", "engineering_it"},
+		[]string{"Medical & Healthcare", "medical"},
+		[]string{"Finance & Accounting", "finance"},
+		[]string{"Education & Research", "education"},
+		[]string{"Legal", "legal"},
+		[]string{"Civil Services", "civil_services"},
+		[]string{"Defence", "defence"},
+		[]string{"Business & Management", "management"},
+		[]string{"Sales & Marketing", "sales_marketing"},
+		[]string{"Arts, Media & Design", "arts_media"},
+		[]string{"Agriculture", "agriculture"},
+		[]string{"Other", "other"},
+	)
+}
+
+func getEmploymentTypes() ListItems {
+	return createList(
+		[]string{"Private sector", EmploymentPrivate},
+		[]string{"Government / Public sector", EmploymentGovernment},
+		[]string{"Business", EmploymentBusiness},
+		[]string{"Self employed", EmploymentSelf},
+		[]string{"Not working", EmploymentNone},
+	)
+}
+
+func (info *CareerInfo) sanitize() {
+	info.Profession = sanitizeText(info.Profession, 100)
+	info.Employer = sanitizeText(info.Employer, 200)
+}
+
+func (info *CareerInfo) validate(ctx echo.Context) error {
+	if info.ProfessionCategory != "" && !getProfessionCategories().Contains(info.ProfessionCategory) {
+		return errors.New(gettext("Profession category is invalid", ctx))
+	}
+
+	if info.EmploymentType != "" && !getEmploymentTypes().Contains(info.EmploymentType) {
+		return errors.New(gettext("Employment type is invalid", ctx))
+	}
+
+	return nil
+}
+
+func (info *CareerInfo) Scan(value interface{}) error {
+	asBytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+
+	err := json.Unmarshal(asBytes, &info)
+
+	return err
+}
+
+func (info CareerInfo) Value() (driver.Value, error) {
+	return json.Marshal(info)
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// ContactUnlock records that a member paid to see another member's contact
+// details. Each pair is only ever charged once.
+type ContactUnlock struct {
+	ID          uint    `gorm:"primary_key" json:"-"`
+	ViewerUUID  string  `gorm:"type:uuid;unique_index:idx_contact_unlocks_pair" json:"-"`
+	ProfileUUID string  `gorm:"type:uuid;unique_index:idx_contact_unlocks_pair" json:"profile_uuid"`
+	Credits     float64 `json:"credits"`
+
+	Profile *ProfileCard `gorm:"-" json:"profile,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// getContactUnlockPrice reads per-plan prices from VM_CONTACT_UNLOCK_PRICES,
+// e.g. "free:50,premium:20", falling back to VM_CONTACT_UNLOCK_PRICE.
+func getContactUnlockPrice(plan string) float64 {
+	for _, p := range strings.Split(os.Getenv("VM_CONTACT_UNLOCK_PRICES"), ",") {
+		parts := strings.Split(strings.TrimSpace(p), ":")
+		if len(parts) != 2 || parts[0] != plan {
+			continue
+		}
+
+		price, err := strconv.ParseFloat(parts[1], 64)
+		if err == nil && price >= 0 {
+			return price
+		}
+	}
+
+	price, err := strconv.ParseFloat(os.Getenv("VM_CONTACT_UNLOCK_PRICE"), 64)
+	if err != nil || price < 0 {
+		price = 50
+	}
+
+	return price
+}
+
+// getUserPlan returns the code of the member's current plan.
+func getUserPlan(u User) string {
+	s, ok := getActiveSubscription(u.UUID)
+	if !ok {
+		return "free"
+	}
+
+	return s.Plan.Code
+}
+
+// unlockContact debits the viewer's wallet and records the unlock in one
+// transaction. An existing unlock for the pair is returned without charging.
+func unlockContact(viewer User, profile User) (ContactUnlock, error) {
+	var cu ContactUnlock
+
+	if !db.Where("viewer_uuid = ? AND profile_uuid = ?", viewer.UUID, profile.UUID).First(&cu).RecordNotFound() {
+		return cu, nil
+	}
+
+	cu.ViewerUUID = viewer.UUID
+	cu.ProfileUUID = profile.UUID
+	cu.Credits = getContactUnlockPrice(getUserPlan(viewer))
+
+	tx := db.Begin()
+
+	// Unlocks included with the plan are used before the wallet
+	if useContactUnlock(tx, viewer.UUID) {
+		cu.Credits = 0
+	}
+
+	if cu.Credits > 0 {
+		_, err := postLedgerEntry(tx, viewer.UUID, LedgerDebit, -cu.Credits, "unlock:"+viewer.UUID+":"+profile.UUID, "Contact unlock")
+		if err != nil {
+			tx.Rollback()
+			return cu, err
+		}
+	}
+
+	err := tx.Create(&cu).Error
+	if err != nil {
+		tx.Rollback()
+
+		// Lost a race with a concurrent unlock of the same pair
+		if !db.Where("viewer_uuid = ? AND profile_uuid = ?", viewer.UUID, profile.UUID).First(&cu).RecordNotFound() {
+			return cu, nil
+		}
+
+		return cu, err
+	}
+
+	tx.Commit()
+
+	return cu, nil
+}
+
+func contactUnlocks(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var cc []ContactUnlock
+
+	db.Where("viewer_uuid = ?", u.UUID).Order("created_at DESC").Find(&cc)
+
+	uuids := make([]string, 0, len(cc))
+	for _, c := range cc {
+		uuids = append(uuids, c.ProfileUUID)
+	}
+
+	cards := getProfileCards(u.UUID, uuids)
+	for i, c := range cc {
+		if p, ok := cards[c.ProfileUUID]; ok {
+			cc[i].Profile = &p
+		}
+	}
+
+	return ctx.JSON(http.StatusOK, cc)
+}
+
+func unlockContactHandler(ctx echo.Context) error {
+	var (
+		p    User
+		data struct {
+			ProfileUUID string `json:"profile_uuid"`
+		}
+	)
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	if data.ProfileUUID == u.UUID || db.Where("uuid = ?", data.ProfileUUID).First(&p).RecordNotFound() || isBlocked(u.UUID, p.UUID) {
+		return ctx.JSON(http.StatusNotFound, gettext("User not found", ctx))
+	}
+
+	ps := p.PrivacySettings
+	ps.applyDefaults()
+	if ps.Phone == PrivacyHidden && ps.Email == PrivacyHidden {
+		return ctx.JSON(http.StatusBadRequest, gettext("This member has hidden their contact details", ctx))
+	}
+
+	cu, err := unlockContact(u, p)
+	if err == errInsufficientBalance {
+		return ctx.JSON(http.StatusPaymentRequired, gettext("You do not have enough credits in your wallet", ctx))
+	}
+
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to unlock contact details", ctx))
+	}
+
+	c := getProfileCard(u.UUID, p)
+	cu.Profile = &c
+
+	return ctx.JSON(http.StatusOK, cu)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo"
+)
+
+// Conversation is a thread between two matched members. The pair is stored
+// with the lower UUID first so each pair has a single thread.
+type Conversation struct {
+	Model
+
+	UserOneUUID   string       `gorm:"type:uuid;unique_index:idx_conversations_pair" json:"-"`
+	UserTwoUUID   string       `gorm:"type:uuid;unique_index:idx_conversations_pair" json:"-"`
+	UserOneMuted  bool         `json:"-"`
+	UserTwoMuted  bool         `json:"-"`
+	LastMessageAt sql.NullTime `gorm:"index" json:"last_message_at"`
+
+	Muted       bool         `gorm:"-" json:"muted"`
+	UnreadCount int          `gorm:"-" json:"unread_count"`
+	LastMessage *Message     `gorm:"-" json:"last_message,omitempty"`
+	Profile     *ProfileCard `gorm:"-" json:"profile,omitempty"`
+}
+
+func getConversationPair(a string, b string) (string, string) {
+	if a < b {
+		return a, b
+	}
+
+	return b, a
+}
+
+func (c *Conversation) hasParticipant(uuid string) bool {
+	return c.UserOneUUID == uuid || c.UserTwoUUID == uuid
+}
+
+func (c *Conversation) getOtherUUID(uuid string) string {
+	if c.UserOneUUID == uuid {
+		return c.UserTwoUUID
+	}
+
+	return c.UserOneUUID
+}
+
+func (c *Conversation) isMutedBy(uuid string) bool {
+	if c.UserOneUUID == uuid {
+		return c.UserOneMuted
+	}
+
+	return c.UserTwoMuted
+}
+
+// canMessage checks that two members are still matched and neither has
+// blocked the other.
+func canMessage(ctx echo.Context, a string, b string) error {
+	var count int
+
+	if isBlocked(a, b) {
+		return errors.New(gettext("You cannot message this member", ctx))
+	}
+
+	db.Model(&UserInterest{}).Where("((from_user_uuid = ? AND to_user_uuid = ?) OR (from_user_uuid = ? AND to_user_uuid = ?)) AND status = ?", a, b, b, a, InterestAccepted).Count(&count)
+
+	if count == 0 {
+		return errors.New(gettext("You can only message members who have accepted your interest", ctx))
+	}
+
+	return nil
+}
+
+// getConversation loads a thread by UUID for one of its participants. Once
+// either member has blocked the other, the thread and its messages are gone
+// for both, as in the conversation list.
+func getConversation(uuid string, userUUID string) (Conversation, error) {
+	var c Conversation
+
+	if db.Where("uuid = ?", uuid).First(&c).RecordNotFound() || !c.hasParticipant(userUUID) {
+		return c, errors.New("Conversation not found")
+	}
+
+	if isBlocked(c.UserOneUUID, c.UserTwoUUID) {
+		return c, errors.New("Conversation not found")
+	}
+
+	c.Muted = c.isMutedBy(userUUID)
+
+	return c, nil
+}
+
+func conversations(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var cc []Conversation
+
+	dbQuery := excludeBlocked(db, u.UUID, "user_one_uuid")
+	dbQuery = excludeBlocked(dbQuery, u.UUID, "user_two_uuid")
+	dbQuery.Where("user_one_uuid = ? OR user_two_uuid = ?", u.UUID, u.UUID).Order("last_message_at DESC NULLS LAST").Find(&cc)
+
+	if len(cc) == 0 {
+		return ctx.JSON(http.StatusOK, cc)
+	}
+
+	ids := make([]uint, 0, len(cc))
+	uuids := make([]string, 0, len(cc))
+	for _, c := range cc {
+		ids = append(ids, c.ID)
+		uuids = append(uuids, c.getOtherUUID(u.UUID))
+	}
+
+	var unread []struct {
+		ConversationID uint
+		Count          int
+	}
+	db.Model(&Message{}).Select("conversation_id, COUNT(id) count").Where("conversation_id IN (?) AND sender_uuid != ? AND read_at IS NULL", ids, u.UUID).Group("conversation_id").Scan(&unread)
+
+	var last []Message
+	db.Where("id IN (SELECT MAX(id) FROM messages WHERE conversation_id IN (?) AND deleted_at IS NULL GROUP BY conversation_id)", ids).Find(&last)
+
+	cards := getProfileCards(u.UUID, uuids)
+
+	for i, c := range cc {
+		cc[i].Muted = c.isMutedBy(u.UUID)
+
+		if p, ok := cards[c.getOtherUUID(u.UUID)]; ok {
+			cc[i].Profile = &p
+		}
+
+		for _, n := range unread {
+			if n.ConversationID == c.ID {
+				cc[i].UnreadCount = n.Count
+			}
+		}
+
+		for _, m := range last {
+			if m.ConversationID == c.ID {
+				m := m
+				cc[i].LastMessage = &m
+			}
+		}
+	}
+
+	return ctx.JSON(http.StatusOK, cc)
+}
+
+// startConversation returns the thread with a matched member, creating it on
+// first use.
+func startConversation(ctx echo.Context) error {
+	var (
+		c    Conversation
+		data struct {
+			UserUUID string `json:"user_uuid"`
+		}
+	)
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	if data.UserUUID == "" || data.UserUUID == u.UUID {
+		return ctx.JSON(http.StatusBadRequest, gettext("Invalid request", ctx))
+	}
+
+	err = canMessage(ctx, u.UUID, data.UserUUID)
+	if err != nil {
+		return ctx.JSON(http.StatusForbidden, err.Error())
+	}
+
+	one, two := getConversationPair(u.UUID, data.UserUUID)
+
+	err = db.Where(Conversation{UserOneUUID: one, UserTwoUUID: two}).FirstOrCreate(&c).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to start conversation", ctx))
+	}
+
+	c.Muted = c.isMutedBy(u.UUID)
+
+	return ctx.JSON(http.StatusOK, c)
+}
+
+func muteConversation(ctx echo.Context) error {
+	var data struct {
+		Muted bool `json:"muted"`
+	}
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	c, err := getConversation(ctx.Param("uuid"), u.UUID)
+	if err != nil {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	column := "user_two_muted"
+	if c.UserOneUUID == u.UUID {
+		column = "user_one_muted"
+	}
+
+	db.Model(&c).Updates(map[string]interface{}{column: data.Muted})
+	c.Muted = data.Muted
+
+	return ctx.JSON(http.StatusOK, c)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const (
+	CouponPercentage = "percentage"
+	CouponFlat       = "flat"
+)
+
+var couponCodeRegexp = regexp.MustCompile(`^[A-Z0-9-]{3,32}$`)
+
+// errCouponUnavailable is returned when a coupon checked at checkout has
+// run out, expired or already been used by the member by the time it is
+// redeemed.
+var errCouponUnavailable = errors.New("Coupon is no longer available")
+
+// Coupon discounts a plan at checkout. A member can use each coupon once.
+type Coupon struct {
+	Model
+
+	Code      string         `gorm:"unique_index" json:"code"`
+	Type      string         `json:"type"`
+	Value     float64        `json:"value"`
+	MaxUses   int            `json:"max_uses"` // 0 for unlimited
+	Uses      int            `json:"uses"`
+	ExpiresAt sql.NullTime   `json:"expires_at"`
+	PlanCodes pq.StringArray `gorm:"type:text[]" json:"plan_codes"` // empty for every plan
+	Active    bool           `json:"active"`
+}
+
+// CouponRedemption records a member's use of a coupon.
+type CouponRedemption struct {
+	Model
+
+	CouponID  uint    `gorm:"unique_index:idx_coupon_redemptions_user" json:"-"`
+	UserUUID  string  `gorm:"type:uuid;unique_index:idx_coupon_redemptions_user" json:"-"`
+	Reference string  `json:"reference"`
+	Discount  float64 `json:"discount"`
+}
+
+func getCouponTypes() []string {
+	return []string{CouponPercentage, CouponFlat}
+}
+
+func (c *Coupon) sanitize() {
+	c.Code = strings.ToUpper(strings.TrimSpace(c.Code))
+
+	pc := make(pq.StringArray, 0, len(c.PlanCodes))
+	for _, p := range c.PlanCodes {
+		if p = strings.TrimSpace(p); p != "" {
+			pc = append(pc, p)
+		}
+	}
+	c.PlanCodes = pc
+}
+
+func (c *Coupon) validate(ctx echo.Context) error {
+	if !couponCodeRegexp.MatchString(c.Code) {
+		return errors.New(gettext("Coupon code is invalid", ctx))
+	}
+
+	if !isOneOf(c.Type, getCouponTypes()) {
+		return errors.New(gettext("Coupon type is invalid", ctx))
+	}
+
+	if c.Value <= 0 || (c.Type == CouponPercentage && c.Value > 100) || c.MaxUses < 0 {
+		return errors.New(gettext("Coupon value is invalid", ctx))
+	}
+
+	return nil
+}
+
+// discountFor returns how much the coupon takes off the plan price.
+func (c *Coupon) discountFor(p Plan) float64 {
+	d := c.Value
+	if c.Type == CouponPercentage {
+		d = p.Price * c.Value / 100
+	}
+
+	if d > p.Price {
+		d = p.Price
+	}
+
+	return roundAmount(d)
+}
+
+// checkCoupon finds a coupon the member can use on the plan.
+func checkCoupon(ctx echo.Context, code string, userUUID string, p Plan) (Coupon, error) {
+	var (
+		c     Coupon
+		count int
+	)
+
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" || db.Where("code = ? AND active = ?", code, true).First(&c).RecordNotFound() {
+		return c, errors.New(gettext("Coupon not found", ctx))
+	}
+
+	if c.ExpiresAt.Valid && c.ExpiresAt.Time.Before(time.Now()) {
+		return c, errors.New(gettext("This coupon has expired", ctx))
+	}
+
+	if c.MaxUses > 0 && c.Uses >= c.MaxUses {
+		return c, errors.New(gettext("This coupon has been fully used", ctx))
+	}
+
+	if len(c.PlanCodes) > 0 && !isOneOf(p.Code, []string(c.PlanCodes)) {
+		return c, errors.New(gettext("This coupon does not apply to this plan", ctx))
+	}
+
+	db.Model(&CouponRedemption{}).Where("coupon_id = ? AND user_uuid = ?", c.ID, userUUID).Count(&count)
+	if count > 0 {
+		return c, errors.New(gettext("You have already used this coupon", ctx))
+	}
+
+	return c, nil
+}
+
+// redeemCoupon counts a use within tx. Limits are checked again here, as
+// checkCoupon runs when the order is created and concurrent checkouts can
+// all pass it. It returns errCouponUnavailable when the member has already
+// redeemed the coupon, e.g. with two payments started at once, or when it
+// has run out or expired since. Nothing is recorded in that case, so the
+// member can still use the coupon later.
+func redeemCoupon(tx *gorm.DB, couponID uint, userUUID string, discount float64, reference string) error {
+	err := tx.Exec("SAVEPOINT redeem_coupon").Error
+	if err != nil {
+		return err
+	}
+
+	res := tx.Exec(`UPDATE coupons SET uses = uses + 1 WHERE id = ? AND active = ?
+		AND (max_uses = 0 OR uses < max_uses) AND (expires_at IS NULL OR expires_at > NOW())`, couponID, true)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return errCouponUnavailable
+	}
+
+	// Conflicts are skipped rather than raised so the transaction stays usable
+	res = tx.Exec(`INSERT INTO coupon_redemptions (created_at, updated_at, coupon_id, user_uuid, reference, discount)
+		VALUES (NOW(), NOW(), ?, ?, ?, ?) ON CONFLICT (coupon_id, user_uuid) DO NOTHING`,
+		couponID, userUUID, reference, discount)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		// Gives back the use counted above
+		err = tx.Exec("ROLLBACK TO SAVEPOINT redeem_coupon").Error
+		if err != nil {
+			return err
+		}
+
+		return errCouponUnavailable
+	}
+
+	return tx.Exec("RELEASE SAVEPOINT redeem_coupon").Error
+}
+
+func checkCouponHandler(ctx echo.Context) error {
+	var data struct {
+		Code     string `json:"code"`
+		PlanCode string `json:"plan_code"`
+	}
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	p, err := getActivePlan(data.PlanCode)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, gettext("Plan not found", ctx))
+	}
+
+	c, err := checkCoupon(ctx, data.Code, u.UUID, p)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	discount := c.discountFor(p)
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"code":     c.Code,
+		"price":    p.Price,
+		"discount": discount,
+		"total":    roundAmount(p.Price - discount),
+	})
+}
+
+func adminCouponsHandler(ctx echo.Context) error {
+	var cc []Coupon
+
+	db.Order("active DESC, id DESC").Find(&cc)
+
+	return ctx.JSON(http.StatusOK, cc)
+}
+
+func adminCreateCouponHandler(ctx echo.Context) error {
+	var c Coupon
+
+	err := ctx.Bind(&c)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	c.zeroID()
+	c.Uses = 0
+	c.sanitize()
+
+	err = c.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	err = db.Create(&c).Error
+	if err != nil {
+		return ctx.JSON(http.StatusConflict, gettext("A coupon with this code already exists", ctx))
+	}
+
+	return ctx.JSON(http.StatusCreated, c)
+}
+
+func adminUpdateCouponHandler(ctx echo.Context) error {
+	var c Coupon
+
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&c).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	id, uuid, code, uses := c.ID, c.UUID, c.Code, c.Uses
+
+	err := ctx.Bind(&c)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	c.ID, c.UUID, c.Code, c.Uses = id, uuid, code, uses
+	c.sanitize()
+
+	err = c.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	err = db.Save(&c).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to save coupon", ctx))
+	}
+
+	return ctx.JSON(http.StatusOK, c)
+}
@@ -3,9 +3,54 @@ package main
 import (
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/labstack/echo"
 )
 
-type EducationalInfo map[string]interface{}
+// Degree is one qualification a member holds.
+type Degree struct {
+	Name        string `json:"name"`
+	Field       string `json:"field"`
+	Institution string `json:"institution"`
+	Year        uint   `json:"year"`
+}
+
+// EducationalInfo holds a member's highest education, which search filters
+// on, and their degrees.
+type EducationalInfo struct {
+	Education string   `json:"education"`
+	Degrees   []Degree `json:"degrees"`
+}
+
+func (info *EducationalInfo) sanitize() {
+	info.Education = sanitizeText(info.Education, 100)
+
+	for i := range info.Degrees {
+		info.Degrees[i].Name = sanitizeText(info.Degrees[i].Name, 100)
+		info.Degrees[i].Field = sanitizeText(info.Degrees[i].Field, 100)
+		info.Degrees[i].Institution = sanitizeText(info.Degrees[i].Institution, 200)
+	}
+}
+
+func (info *EducationalInfo) validate(ctx echo.Context) error {
+	if len(info.Degrees) > 10 {
+		return errors.New(gettext("Too many degrees", ctx))
+	}
+
+	for _, d := range info.Degrees {
+		if d.Name == "" {
+			return errors.New(gettext("Degree name is required", ctx))
+		}
+
+		if d.Year != 0 && (d.Year < 1950 || int(d.Year) > time.Now().Year()+6) {
+			return errors.New(gettext("Degree year is invalid", ctx))
+		}
+	}
+
+	return nil
+}
 
 func (info *EducationalInfo) Scan(value interface{}) error {
 	asBytes, ok := value.([]byte)
@@ -14,8 +59,18 @@ func (info *EducationalInfo) Scan(value interface{}) error {
 	}
 
 	err := json.Unmarshal(asBytes, &info)
+	if err != nil {
+		// Degrees used to be free-form
+		var legacy map[string]interface{}
+		if json.Unmarshal(asBytes, &legacy) != nil {
+			return err
+		}
+
+		*info = EducationalInfo{}
+		setLegacyString(&info.Education, legacy, "education")
+	}
 
-	return err
+	return nil
 }
 
 func (info EducationalInfo) Value() (driver.Value, error) {
@@ -22,7 +22,7 @@ type EmailTemplate struct {
 }
 
 func getEmailTemplateSlugs() []string {
-	return []string{"user-email-added", "user-email-removed", "user-email-verify", "user-forgot-password", "user-login-link", "user-password-changed", "user-update-personal-email", "user-verify-link", "user-welcome", "user-subscribe-welcome"}
+	return []string{"user-email-added", "user-email-removed", "user-email-verify", "user-forgot-password", "user-login-link", "user-password-changed", "user-update-personal-email", "user-verify-link", "user-welcome", "user-subscribe-welcome", "user-subscription-expiring", "user-invoice"}
 }
 
 func (e *EmailTemplate) sanitize(ctx echo.Context) {
@@ -85,7 +85,7 @@ func (e *EmailTemplate) getExistsMessage(ctx echo.Context) string {
 	return "An email template with in this language this slug already exists"
 }
 
-func (e *EmailTemplate) doSearch(params SearchQuery) (interface{}, error) {
+func (e *EmailTemplate) doSearch(viewer User, params SearchQuery) (interface{}, error) {
 	var ee []EmailTemplate
 
 	dbQuery := db
@@ -114,7 +114,7 @@ func (e *EmailTemplate) restore(ctx echo.Context, tx *gorm.DB) error {
 	return nil
 }
 
-func (e *EmailTemplate) bulkRead(slugs []string) (interface{}, error) {
+func (e *EmailTemplate) bulkRead(viewer User, slugs []string) (interface{}, error) {
 	var ee []EmailTemplate
 
 	db.Where("slug IN(?)", slugs).Find(&ee)
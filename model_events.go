@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const eventsChannel = "vm_events"
+
+const (
+	EventNotification = "notification"
+	EventInterest     = "interest"
+	EventMessage      = "message"
+	EventRead         = "read"
+	EventTyping       = "typing"
+	EventResync       = "resync" // more was missed than can be replayed
+)
+
+// maxReplayedEvents is how many missed events a reconnecting client is sent.
+const maxReplayedEvents = 200
+
+// Event is a real-time update kept for a while so that clients can resume
+// from the last ID they received after reconnecting. Typing indicators are
+// not stored.
+type Event struct {
+	ID        uint64    `gorm:"primary_key" json:"id"`
+	UserUUID  string    `gorm:"type:uuid;index" json:"-"`
+	Type      string    `json:"type"`
+	Payload   string    `gorm:"type:jsonb" json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// eventMessage is what is sent over NOTIFY and to the client.
+type eventMessage struct {
+	ID        uint64          `json:"id,omitempty"`
+	UserUUID  string          `json:"user_uuid,omitempty"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload,omitempty"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func (e Event) message() eventMessage {
+	return eventMessage{
+		ID:        e.ID,
+		Type:      e.Type,
+		Payload:   json.RawMessage(e.Payload),
+		CreatedAt: e.CreatedAt,
+	}
+}
+
+// publishEvent stores an event for a member and announces it to every API
+// instance through Postgres NOTIFY.
+func publishEvent(userUUID string, eventType string, payload interface{}) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		log.Println("Error while encoding event: ", err.Error())
+		return
+	}
+
+	m := eventMessage{UserUUID: userUUID, Type: eventType, CreatedAt: time.Now()}
+
+	if eventType == EventTyping {
+		m.Payload = b
+	} else {
+		e := Event{UserUUID: userUUID, Type: eventType, Payload: string(b)}
+
+		err = db.Create(&e).Error
+		if err != nil {
+			log.Println("Error while saving event: ", err.Error())
+			return
+		}
+
+		// NOTIFY payloads are limited in size so listeners load stored events
+		m.ID = e.ID
+	}
+
+	n, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	err = db.Exec("SELECT pg_notify(?, ?)", eventsChannel, string(n)).Error
+	if err != nil {
+		log.Println("Error while publishing event: ", err.Error())
+	}
+}
+
+// getEventsSince returns the events after lastID, oldest first. It returns
+// false when there are more than maxReplayedEvents of them, or when some may
+// have been purged already.
+func getEventsSince(userUUID string, lastID uint64) ([]Event, bool) {
+	var (
+		ee     []Event
+		oldest struct {
+			ID uint64
+		}
+	)
+
+	db.Where("user_uuid = ? AND id > ?", userUUID, lastID).Order("id ASC").Limit(maxReplayedEvents + 1).Find(&ee)
+
+	if len(ee) > maxReplayedEvents {
+		return ee[:maxReplayedEvents], false
+	}
+
+	db.Model(&Event{}).Select("COALESCE(MIN(id), 0) AS id").Scan(&oldest)
+
+	return ee, oldest.ID <= lastID+1
+}
+
+func purgeEvents() {
+	db.Where("created_at < ?", time.Now().AddDate(0, 0, -7)).Delete(&Event{})
+}
@@ -3,9 +3,69 @@ package main
 import (
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	FamilyJoint    = "joint"
+	FamilyNuclear  = "nuclear"
+	FamilyExtended = "extended"
 )
 
-type FamilyInfo map[string]interface{}
+// FamilyInfo describes a member's family.
+type FamilyInfo struct {
+	FatherOccupation string `json:"father_occupation"`
+	MotherOccupation string `json:"mother_occupation"`
+	Brothers         uint   `json:"brothers"`
+	BrothersMarried  uint   `json:"brothers_married"`
+	Sisters          uint   `json:"sisters"`
+	SistersMarried   uint   `json:"sisters_married"`
+	FamilyType       string `json:"family_type"`
+	NativePlace      string `json:"native_place"`
+}
+
+func getFamilyTypes() ListItems {
+	return createList(
+		[]string{"Joint family", FamilyJoint},
+		[]string{"Nuclear family", FamilyNuclear},
+		[]string{"Extended family", FamilyExtended},
+	)
+}
+
+// normalizeFamilyType maps free text such as "Joint Family" to a family
+// type. Anything else is dropped, as it would fail validation.
+func normalizeFamilyType(s string) string {
+	s = strings.ToLower(s)
+
+	for _, t := range []string{FamilyJoint, FamilyNuclear, FamilyExtended} {
+		if strings.Contains(s, t) {
+			return t
+		}
+	}
+
+	return ""
+}
+
+func (info *FamilyInfo) sanitize() {
+	info.FatherOccupation = sanitizeText(info.FatherOccupation, 100)
+	info.MotherOccupation = sanitizeText(info.MotherOccupation, 100)
+	info.NativePlace = sanitizeText(info.NativePlace, 100)
+}
+
+func (info *FamilyInfo) validate(ctx echo.Context) error {
+	if info.FamilyType != "" && !getFamilyTypes().Contains(info.FamilyType) {
+		return errors.New(gettext("Family type is invalid", ctx))
+	}
+
+	if info.Brothers > 20 || info.Sisters > 20 || info.BrothersMarried > info.Brothers || info.SistersMarried > info.Sisters {
+		return errors.New(gettext("Number of siblings is invalid", ctx))
+	}
+
+	return nil
+}
 
 func (info *FamilyInfo) Scan(value interface{}) error {
 	asBytes, ok := value.([]byte)
@@ -13,11 +73,42 @@ func (info *FamilyInfo) Scan(value interface{}) error {
 		return nil
 	}
 
-	err := json.Unmarshal(asBytes, &info)
+	var legacy map[string]interface{}
+
+	err := json.Unmarshal(asBytes, &legacy)
+	if err != nil {
+		return err
+	}
 
-	return err
+	// Profiles saved before the schema was typed used other key names and
+	// sometimes strings for numbers
+	if json.Unmarshal(asBytes, &info) != nil {
+		*info = FamilyInfo{}
+	}
+
+	setLegacyString(&info.FatherOccupation, legacy, "father_occupation", "fatherOccupation", "father_profession", "father")
+	setLegacyString(&info.MotherOccupation, legacy, "mother_occupation", "motherOccupation", "mother_profession", "mother")
+	setLegacyString(&info.FamilyType, legacy, "family_type", "familyType")
+	setLegacyString(&info.NativePlace, legacy, "native_place", "nativePlace", "native")
+	setLegacyUint(&info.Brothers, legacy, "brothers", "brother", "no_of_brothers")
+	setLegacyUint(&info.Sisters, legacy, "sisters", "sister", "no_of_sisters")
+
+	info.FamilyType = normalizeFamilyType(info.FamilyType)
+
+	return nil
 }
 
 func (info FamilyInfo) Value() (driver.Value, error) {
 	return json.Marshal(info)
 }
+
+// migrateFamilyTypes maps the free-text family types that migrateProfileInfo
+// copied over as they were, the same way normalizeFamilyType does.
+func migrateFamilyTypes() {
+	db.Exec(`UPDATE users SET family_info = jsonb_set(family_info, '{family_type}', to_jsonb(CASE
+			WHEN LOWER(family_info->>'family_type') LIKE '%joint%' THEN 'joint'
+			WHEN LOWER(family_info->>'family_type') LIKE '%nuclear%' THEN 'nuclear'
+			WHEN LOWER(family_info->>'family_type') LIKE '%extended%' THEN 'extended'
+			ELSE '' END))
+		WHERE jsonb_typeof(family_info) = 'object' AND family_info->>'family_type' NOT IN ('', 'joint', 'nuclear', 'extended')`)
+}
@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+// Invoice is the GST tax invoice for a successful payment. Amounts paid are
+// inclusive of GST. Wallet top-ups are taxed when they are paid, so plans
+// later bought with the credits are not invoiced again. Invoices are
+// numbered without gaps within each Indian financial year (April to March).
+type Invoice struct {
+	Model
+
+	Number        string     `gorm:"unique_index" json:"number"`
+	FinancialYear string     `gorm:"index" json:"financial_year"`
+	PaymentID     uint       `gorm:"unique_index" json:"-"`
+	UserUUID      string     `gorm:"type:uuid;index" json:"-"`
+	IssuedAt      time.Time  `json:"issued_at"`
+	EmailedAt     *time.Time `json:"-"`
+	EmailAttempts int        `gorm:"not null;default:0" json:"-"`
+
+	CustomerName    string `json:"customer_name"`
+	CustomerAddress string `json:"customer_address"`
+	CustomerState   string `json:"customer_state"`
+	Description     string `json:"description"`
+
+	TaxableAmount float64 `json:"taxable_amount"`
+	GSTRate       float64 `json:"gst_rate"`
+	CGST          float64 `json:"cgst"`
+	SGST          float64 `json:"sgst"`
+	IGST          float64 `json:"igst"`
+	Total         float64 `json:"total"`
+}
+
+// InvoiceSequence holds the last invoice number used in a financial year.
+type InvoiceSequence struct {
+	FinancialYear string `gorm:"primary_key"`
+	LastNumber    int
+}
+
+var indiaTimezone = time.FixedZone("IST", 5*60*60+30*60)
+
+// getFinancialYear returns the financial year of t, e.g. "2026-27".
+func getFinancialYear(t time.Time) string {
+	t = t.In(indiaTimezone)
+
+	y := t.Year()
+	if t.Month() < time.April {
+		y--
+	}
+
+	return fmt.Sprintf("%d-%02d", y, (y+1)%100)
+}
+
+func getGSTRate() float64 {
+	rate, err := strconv.ParseFloat(os.Getenv("VM_GST_RATE"), 64)
+	if err != nil || rate < 0 {
+		rate = 18
+	}
+
+	return rate
+}
+
+// applyTax splits the total into the taxable value and GST. Supplies within
+// our own state carry CGST and SGST, other states IGST. Without a customer
+// state the place of supply is our own.
+func (i *Invoice) applyTax() {
+	i.GSTRate = getGSTRate()
+	i.TaxableAmount = roundAmount(i.Total * 100 / (100 + i.GSTRate))
+
+	tax := roundAmount(i.Total - i.TaxableAmount)
+
+	if i.CustomerState == "" || strings.EqualFold(strings.TrimSpace(i.CustomerState), strings.TrimSpace(os.Getenv("VM_GST_STATE"))) {
+		paise := int64(math.Round(tax * 100))
+		i.CGST = float64(paise/2) / 100
+		i.SGST = float64(paise-paise/2) / 100
+	} else {
+		i.IGST = tax
+	}
+}
+
+func (i *Invoice) fileName() string {
+	return "invoice-" + strings.Replace(i.Number, "/", "-", -1) + ".pdf"
+}
+
+func (i *Invoice) renderPDF() []byte {
+	d := newPDFDocument()
+
+	d.text(40, 60, 18, true, "Tax Invoice")
+	d.text(40, 85, 11, true, os.Getenv("VM_INVOICE_SELLER_NAME"))
+	d.text(40, 100, 9, false, os.Getenv("VM_INVOICE_SELLER_ADDRESS"))
+	d.text(40, 114, 9, false, "GSTIN: "+os.Getenv("VM_GSTIN")+"   State: "+os.Getenv("VM_GST_STATE"))
+
+	d.text(380, 85, 9, false, "Invoice no: "+i.Number)
+	d.text(380, 100, 9, false, "Date: "+i.IssuedAt.In(indiaTimezone).Format("02 Jan 2006"))
+
+	d.line(40, 130, 555, 130)
+
+	d.text(40, 150, 10, true, "Billed to")
+	d.text(40, 165, 9, false, i.CustomerName)
+	d.text(40, 179, 9, false, i.CustomerAddress)
+	d.text(40, 193, 9, false, "Place of supply: "+i.placeOfSupply())
+
+	d.line(40, 215, 555, 215)
+	d.text(40, 230, 9, true, "Description")
+	if sac := os.Getenv("VM_INVOICE_SAC"); sac != "" {
+		d.text(330, 230, 9, true, "SAC")
+		d.text(330, 250, 9, false, sac)
+	}
+	d.text(460, 230, 9, true, "Amount (INR)")
+	d.line(40, 238, 555, 238)
+	d.text(40, 250, 9, false, i.Description)
+	d.text(460, 250, 9, false, fmt.Sprintf("%.2f", i.TaxableAmount))
+
+	y := 280.0
+	rows := [][2]string{
+		{"Taxable value", fmt.Sprintf("%.2f", i.TaxableAmount)},
+	}
+
+	if i.IGST > 0 {
+		rows = append(rows, [2]string{fmt.Sprintf("IGST @ %g%%", i.GSTRate), fmt.Sprintf("%.2f", i.IGST)})
+	} else {
+		rows = append(rows,
+			[2]string{fmt.Sprintf("CGST @ %g%%", i.GSTRate/2), fmt.Sprintf("%.2f", i.CGST)},
+			[2]string{fmt.Sprintf("SGST @ %g%%", i.GSTRate/2), fmt.Sprintf("%.2f", i.SGST)},
+		)
+	}
+
+	for _, r := range rows {
+		d.text(330, y, 9, false, r[0])
+		d.text(460, y, 9, false, r[1])
+		y += 15
+	}
+
+	d.line(330, y-5, 555, y-5)
+	d.text(330, y+8, 10, true, "Total")
+	d.text(460, y+8, 10, true, fmt.Sprintf("%.2f", i.Total))
+
+	d.text(40, 780, 8, false, "This is a computer generated invoice and does not require a signature.")
+
+	return d.bytes()
+}
+
+func (i *Invoice) placeOfSupply() string {
+	if i.CustomerState == "" {
+		return os.Getenv("VM_GST_STATE")
+	}
+
+	return i.CustomerState
+}
+
+// maxInvoiceEmailAttempts is how often issueMissingInvoices tries to email
+// an invoice before leaving it to the member's invoice list.
+const maxInvoiceEmailAttempts = 5
+
+// newInvoice fills in the customer and tax of an invoice for total.
+func newInvoice(userUUID string, total float64, description string) Invoice {
+	var u User
+
+	db.Unscoped().Where("uuid = ?", userUUID).First(&u)
+
+	address := []string{}
+	for _, a := range []string{u.Address1, u.Address2, u.City, u.District, u.State, u.PostalCode} {
+		if strings.TrimSpace(a) != "" {
+			address = append(address, strings.TrimSpace(a))
+		}
+	}
+
+	i := Invoice{
+		UserUUID:        userUUID,
+		IssuedAt:        time.Now(),
+		CustomerName:    u.getName(),
+		CustomerAddress: strings.Join(address, ", "),
+		CustomerState:   u.State,
+		Description:     description,
+		Total:           total,
+	}
+
+	i.FinancialYear = getFinancialYear(i.IssuedAt)
+	i.applyTax()
+
+	return i
+}
+
+func getPlanInvoiceDescription(planID uint) string {
+	var plan Plan
+
+	db.Unscoped().Where("id = ?", planID).First(&plan)
+
+	return plan.Name + " membership (" + strconv.Itoa(plan.DurationDays) + " days)"
+}
+
+// issueInvoice creates the invoice of a successful payment, once.
+func issueInvoice(p Payment) (Invoice, error) {
+	var i Invoice
+
+	if !db.Where("payment_id = ?", p.ID).First(&i).RecordNotFound() {
+		return i, nil
+	}
+
+	description := "Wallet credits"
+	if p.PlanID != 0 {
+		description = getPlanInvoiceDescription(p.PlanID)
+	}
+
+	i = newInvoice(p.UserUUID, p.Amount, description)
+	i.PaymentID = p.ID
+
+	return i, i.create()
+}
+
+// create numbers and saves the invoice.
+func (i *Invoice) create() error {
+	prefix := os.Getenv("VM_INVOICE_PREFIX")
+	if prefix == "" {
+		prefix = "VM"
+	}
+
+	tx := db.Begin()
+
+	// The counter row is locked until commit, so numbers are never skipped
+	var n int
+	err := tx.Raw(`INSERT INTO invoice_sequences (financial_year, last_number) VALUES (?, 1)
+		ON CONFLICT (financial_year) DO UPDATE SET last_number = invoice_sequences.last_number + 1
+		RETURNING last_number`, i.FinancialYear).Row().Scan(&n)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	i.Number = fmt.Sprintf("%s/%s/%06d", prefix, i.FinancialYear, n)
+
+	err = tx.Create(i).Error
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit().Error
+}
+
+func (i *Invoice) send() {
+	var u User
+
+	// Counted up front, so an invoice that cannot be sent is not retried for ever
+	db.Model(&Invoice{}).Where("id = ?", i.ID).UpdateColumn("email_attempts", gorm.Expr("email_attempts + 1"))
+
+	if db.Where("uuid = ?", i.UserUUID).First(&u).RecordNotFound() || u.Email == "" {
+		return
+	}
+
+	vars := map[string]string{
+		"invoice_number": i.Number,
+		"invoice_total":  fmt.Sprintf("%.2f", i.Total),
+	}
+
+	a := Attachment{
+		Filename: i.fileName(),
+		Type:     "application/pdf",
+		Content:  base64.StdEncoding.EncodeToString(i.renderPDF()),
+	}
+
+	err := u.notify("user-invoice", string(u.Email), vars, []Attachment{a})
+	if err != nil {
+		log.Println("Error while sending invoice: ", err.Error())
+		return
+	}
+
+	db.Model(&Invoice{}).Where("id = ?", i.ID).Updates(map[string]interface{}{"emailed_at": time.Now()})
+}
+
+func issueAndSendInvoice(p Payment) {
+	i, err := issueInvoice(p)
+	if err != nil {
+		log.Println("Error while issuing invoice: ", err.Error())
+		return
+	}
+
+	if i.EmailedAt == nil {
+		i.send()
+	}
+}
+
+// issueMissingInvoices catches successful payments whose invoice failed, and
+// retries invoices that could not be emailed.
+func issueMissingInvoices() {
+	var (
+		pp []Payment
+		ii []Invoice
+	)
+
+	since := time.Now().AddDate(0, 0, -30)
+
+	db.Where("status = ? AND amount > 0 AND updated_at > ? AND NOT EXISTS (SELECT 1 FROM invoices i WHERE i.payment_id = payments.id)", PaymentSuccess, since).Find(&pp)
+
+	for _, p := range pp {
+		issueAndSendInvoice(p)
+	}
+
+	db.Where("emailed_at IS NULL AND email_attempts < ? AND issued_at > ?", maxInvoiceEmailAttempts, since).Find(&ii)
+
+	for _, i := range ii {
+		i.send()
+	}
+}
+
+func invoices(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var ii []Invoice
+
+	db.Where("user_uuid = ?", u.UUID).Order("issued_at DESC").Find(&ii)
+
+	return ctx.JSON(http.StatusOK, ii)
+}
+
+func downloadInvoice(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var i Invoice
+
+	if db.Where("uuid = ? AND user_uuid = ?", ctx.Param("uuid"), u.UUID).First(&i).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	ctx.Response().Header().Set("Content-Disposition", `attachment; filename="`+i.fileName()+`"`)
+
+	return ctx.Blob(http.StatusOK, "application/pdf", i.renderPDF())
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// setTestEnv sets an environment variable for the rest of the test.
+func setTestEnv(t *testing.T, key string, value string) {
+	t.Helper()
+
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, value)
+
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	})
+}
+
+func TestGetFinancialYear(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		want string
+	}{
+		{time.Date(2026, time.April, 1, 0, 0, 0, 0, indiaTimezone), "2026-27"},
+		{time.Date(2026, time.March, 31, 23, 59, 0, 0, indiaTimezone), "2025-26"},
+		{time.Date(2027, time.January, 15, 12, 0, 0, 0, indiaTimezone), "2026-27"},
+		// Still March in UTC, already April in India
+		{time.Date(2026, time.March, 31, 20, 0, 0, 0, time.UTC), "2026-27"},
+		{time.Date(1999, time.May, 1, 0, 0, 0, 0, indiaTimezone), "1999-00"},
+	}
+
+	for _, tt := range tests {
+		if got := getFinancialYear(tt.t); got != tt.want {
+			t.Errorf("getFinancialYear(%s) = %s, want %s", tt.t, got, tt.want)
+		}
+	}
+}
+
+func TestApplyTax(t *testing.T) {
+	setTestEnv(t, "VM_GST_RATE", "18")
+	setTestEnv(t, "VM_GST_STATE", "Maharashtra")
+
+	tests := []struct {
+		total   float64
+		state   string
+		taxable float64
+		cgst    float64
+		sgst    float64
+		igst    float64
+	}{
+		{499, "Maharashtra", 422.88, 38.06, 38.06, 0},
+		{499, " maharashtra ", 422.88, 38.06, 38.06, 0},
+		{499, "", 422.88, 38.06, 38.06, 0},
+		{499, "Karnataka", 422.88, 0, 0, 76.12},
+		// An odd paisa goes to SGST
+		{100, "Maharashtra", 84.75, 7.62, 7.63, 0},
+	}
+
+	for _, tt := range tests {
+		i := Invoice{Total: tt.total, CustomerState: tt.state}
+		i.applyTax()
+
+		if i.TaxableAmount != tt.taxable || i.CGST != tt.cgst || i.SGST != tt.sgst || i.IGST != tt.igst {
+			t.Errorf("%.2f to %q: got taxable %.2f, CGST %.2f, SGST %.2f, IGST %.2f, want %.2f, %.2f, %.2f, %.2f",
+				tt.total, tt.state, i.TaxableAmount, i.CGST, i.SGST, i.IGST, tt.taxable, tt.cgst, tt.sgst, tt.igst)
+		}
+	}
+}
+
+// The parts of an invoice must always add up to what was paid.
+func TestApplyTaxAddsUpToTotal(t *testing.T) {
+	setTestEnv(t, "VM_GST_RATE", "18")
+	setTestEnv(t, "VM_GST_STATE", "Maharashtra")
+
+	for _, total := range []float64{1, 9.99, 99, 101, 499, 999, 1499.5, 4999} {
+		for _, state := range []string{"Maharashtra", "Goa"} {
+			i := Invoice{Total: total, CustomerState: state}
+			i.applyTax()
+
+			if sum := roundAmount(i.TaxableAmount + i.CGST + i.SGST + i.IGST); sum != total {
+				t.Errorf("%.2f to %s: parts add up to %.2f", total, state, sum)
+			}
+		}
+	}
+}
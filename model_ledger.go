@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	LedgerCredit     = "credit"
+	LedgerDebit      = "debit"
+	LedgerRefund     = "refund"
+	LedgerBonus      = "bonus"
+	LedgerAdjustment = "adjustment"
+)
+
+// System accounts on the other side of every wallet posting.
+const (
+	AccountPayments    = "system:payments"
+	AccountRevenue     = "system:revenue"
+	AccountRefunds     = "system:refunds"
+	AccountPromotions  = "system:promotions"
+	AccountAdjustments = "system:adjustments"
+)
+
+var ledgerCounterAccounts = map[string]string{
+	LedgerCredit:     AccountPayments,
+	LedgerDebit:      AccountRevenue,
+	LedgerRefund:     AccountRefunds,
+	LedgerBonus:      AccountPromotions,
+	LedgerAdjustment: AccountAdjustments,
+}
+
+var (
+	errDuplicateLedgerEntry = errors.New("Ledger entry already posted")
+	errInsufficientBalance  = errors.New("Insufficient wallet balance")
+)
+
+// LedgerEntry is one leg of a wallet transaction. Every transaction posts a
+// leg to the member's wallet account and an opposite leg to a system
+// account, so the entries of a transaction always sum to zero. Entries are
+// never updated or deleted; mistakes are corrected with new entries.
+type LedgerEntry struct {
+	ID            uint      `gorm:"primary_key" json:"-"`
+	TransactionID string    `gorm:"type:uuid;index" json:"transaction_id"`
+	Account       string    `gorm:"index;unique_index:idx_ledger_entries_reference" json:"-"`
+	Type          string    `json:"type"`
+	Amount        float64   `json:"amount"`
+	BalanceAfter  float64   `json:"balance_after"`
+	Reference     string    `gorm:"unique_index:idx_ledger_entries_reference" json:"reference"`
+	Description   string    `json:"description"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+func (e *LedgerEntry) BeforeUpdate() error {
+	return errors.New("Ledger entries cannot be changed")
+}
+
+func (e *LedgerEntry) BeforeDelete() error {
+	return errors.New("Ledger entries cannot be deleted")
+}
+
+func walletAccount(userUUID string) string {
+	return "wallet:" + userUUID
+}
+
+func roundAmount(a float64) float64 {
+	return math.Round(a*100) / 100
+}
+
+// postLedgerEntry moves amount into (or, when negative, out of) a member's
+// wallet within tx and updates the cached balance. The reference makes the
+// posting idempotent: posting it again returns errDuplicateLedgerEntry.
+func postLedgerEntry(tx *gorm.DB, userUUID string, entryType string, amount float64, reference string, description string) (LedgerEntry, error) {
+	var (
+		w Wallet
+		e LedgerEntry
+	)
+
+	counter, ok := ledgerCounterAccounts[entryType]
+	if !ok {
+		return e, errors.New("Invalid ledger entry type")
+	}
+
+	amount = roundAmount(amount)
+	if amount == 0 {
+		return e, errors.New("Invalid ledger amount")
+	}
+
+	if !tx.Where("account = ? AND reference = ?", walletAccount(userUUID), reference).First(&e).RecordNotFound() {
+		return e, errDuplicateLedgerEntry
+	}
+
+	if tx.Set("gorm:query_option", "FOR UPDATE").Where("user_uuid = ?", userUUID).First(&w).RecordNotFound() {
+		w = Wallet{UserUUID: userUUID}
+
+		err := tx.Create(&w).Error
+		if err != nil {
+			return e, err
+		}
+	}
+
+	balance := roundAmount(w.Balance + amount)
+	if amount < 0 && balance < 0 {
+		return e, errInsufficientBalance
+	}
+
+	err := tx.Model(&w).Updates(map[string]interface{}{"balance": balance}).Error
+	if err != nil {
+		return e, err
+	}
+
+	txID := uuid.NewV4().String()
+
+	e = LedgerEntry{
+		TransactionID: txID,
+		Account:       walletAccount(userUUID),
+		Type:          entryType,
+		Amount:        amount,
+		BalanceAfter:  balance,
+		Reference:     reference,
+		Description:   description,
+	}
+
+	err = tx.Create(&e).Error
+	if err != nil {
+		return e, err
+	}
+
+	err = tx.Create(&LedgerEntry{
+		TransactionID: txID,
+		Account:       counter,
+		Type:          entryType,
+		Amount:        -amount,
+		Reference:     reference,
+		Description:   description,
+	}).Error
+
+	return e, err
+}
+
+// postWalletTransaction posts a single entry in its own transaction.
+func postWalletTransaction(userUUID string, entryType string, amount float64, reference string, description string) (LedgerEntry, error) {
+	tx := db.Begin()
+
+	e, err := postLedgerEntry(tx, userUUID, entryType, amount, reference, description)
+	if err != nil {
+		tx.Rollback()
+		return e, err
+	}
+
+	return e, tx.Commit().Error
+}
+
+func walletTransactions(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	page, err := strconv.Atoi(ctx.QueryParam("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit := 20
+
+	var ee []LedgerEntry
+
+	dbQuery := db.Where("account = ?", walletAccount(u.UUID))
+
+	if t := ctx.QueryParam("type"); t != "" {
+		dbQuery = dbQuery.Where("type = ?", t)
+	}
+
+	dbQuery.Order("id DESC").Limit(limit).Offset(limit * (page - 1)).Find(&ee)
+
+	return ctx.JSON(http.StatusOK, ee)
+}
+
+// walletMismatch is a wallet whose cached balance is not its ledger total.
+type walletMismatch struct {
+	UserUUID string
+	Balance  float64
+	Total    float64
+}
+
+// getWalletMismatches compares every cached wallet balance with the sum of
+// its ledger entries.
+func getWalletMismatches() []walletMismatch {
+	var rr []walletMismatch
+
+	db.Raw(`SELECT w.user_uuid, w.balance, COALESCE(SUM(l.amount), 0) AS total
+		FROM wallets w
+		LEFT JOIN ledger_entries l ON l.account = 'wallet:' || w.user_uuid::text
+		WHERE w.deleted_at IS NULL
+		GROUP BY w.id, w.user_uuid, w.balance
+		HAVING ROUND(w.balance::numeric, 2) != ROUND(COALESCE(SUM(l.amount), 0)::numeric, 2)`).Scan(&rr)
+
+	return rr
+}
+
+// reconcileWallets reports the wallets that disagree with their ledger.
+func reconcileWallets() {
+	rr := getWalletMismatches()
+
+	if len(rr) == 0 {
+		log.Print("Wallets reconciled")
+		return
+	}
+
+	text := ""
+	for _, r := range rr {
+		log.Printf("Wallet %s has balance %.2f but ledger total %.2f", r.UserUUID, r.Balance, r.Total)
+		text += r.UserUUID + ": balance " + strconv.FormatFloat(r.Balance, 'f', 2, 64) + ", ledger " + strconv.FormatFloat(r.Total, 'f', 2, 64) + "<br>"
+	}
+
+	go sendDebugEmail("Wallet reconciliation mismatch", text)
+}
+
+// migrateWalletLedger removes the old balance trigger and opens the ledger of
+// existing wallets with their current balance.
+func migrateWalletLedger() {
+	db.Exec("DROP TRIGGER IF EXISTS add_amount_trigger ON payments")
+	db.Exec("DROP FUNCTION IF EXISTS add_amount_to_wallet()")
+
+	var ww []Wallet
+
+	db.Where("balance != 0 AND NOT EXISTS (SELECT 1 FROM ledger_entries l WHERE l.account = 'wallet:' || wallets.user_uuid::text)").Find(&ww)
+
+	for _, w := range ww {
+		txID := uuid.NewV4().String()
+		reference := "opening:" + strconv.Itoa(int(w.ID))
+
+		tx := db.Begin()
+
+		err := tx.Create(&LedgerEntry{TransactionID: txID, Account: walletAccount(w.UserUUID), Type: LedgerAdjustment, Amount: w.Balance, BalanceAfter: w.Balance, Reference: reference, Description: "Opening balance"}).Error
+		if err == nil {
+			err = tx.Create(&LedgerEntry{TransactionID: txID, Account: AccountAdjustments, Type: LedgerAdjustment, Amount: -w.Balance, Reference: reference, Description: "Opening balance"}).Error
+		}
+
+		if err != nil {
+			tx.Rollback()
+			log.Println("Error while opening wallet ledger: ", err.Error())
+			continue
+		}
+
+		tx.Commit()
+	}
+}
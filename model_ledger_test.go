@@ -0,0 +1,108 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPostLedgerEntry(t *testing.T) {
+	setupTestDB(t)
+
+	userUUID := newTestUserUUID()
+
+	e, err := postWalletTransaction(userUUID, LedgerCredit, 100, "test-credit:"+userUUID, "Test top-up")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Amount != 100 || e.BalanceAfter != 100 {
+		t.Errorf("got amount %.2f and balance %.2f, want 100 and 100", e.Amount, e.BalanceAfter)
+	}
+
+	_, err = postWalletTransaction(userUUID, LedgerDebit, -40, "test-debit:"+userUUID, "Test purchase")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := getTestBalance(t, userUUID); b != 60 {
+		t.Errorf("got balance %.2f, want 60", b)
+	}
+}
+
+func TestPostLedgerEntryBalancesEachTransaction(t *testing.T) {
+	setupTestDB(t)
+
+	var total struct {
+		Legs  int
+		Total float64
+	}
+
+	userUUID := newTestUserUUID()
+
+	e, err := postWalletTransaction(userUUID, LedgerBonus, 25, "test-bonus:"+userUUID, "Test bonus")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Raw("SELECT COUNT(*) AS legs, COALESCE(SUM(amount), 0) AS total FROM ledger_entries WHERE transaction_id = ?", e.TransactionID).Scan(&total)
+
+	if total.Legs != 2 || total.Total != 0 {
+		t.Errorf("got %d legs summing to %.2f, want 2 legs summing to 0", total.Legs, total.Total)
+	}
+}
+
+func TestPostLedgerEntryIsIdempotent(t *testing.T) {
+	setupTestDB(t)
+
+	userUUID := newTestUserUUID()
+	reference := "test-credit:" + userUUID
+
+	_, err := postWalletTransaction(userUUID, LedgerCredit, 100, reference, "Test top-up")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = postWalletTransaction(userUUID, LedgerCredit, 100, reference, "Test top-up")
+	if err != errDuplicateLedgerEntry {
+		t.Errorf("got error %v, want errDuplicateLedgerEntry", err)
+	}
+
+	if b := getTestBalance(t, userUUID); b != 100 {
+		t.Errorf("got balance %.2f, want 100", b)
+	}
+}
+
+func TestPostLedgerEntryRejectsOverdraft(t *testing.T) {
+	setupTestDB(t)
+
+	userUUID := newTestUserUUID()
+
+	_, err := postWalletTransaction(userUUID, LedgerCredit, 50, "test-credit:"+userUUID, "Test top-up")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = postWalletTransaction(userUUID, LedgerDebit, -50.01, "test-debit:"+userUUID, "Test purchase")
+	if err != errInsufficientBalance {
+		t.Errorf("got error %v, want errInsufficientBalance", err)
+	}
+
+	if b := getTestBalance(t, userUUID); b != 50 {
+		t.Errorf("got balance %.2f, want 50", b)
+	}
+}
+
+func TestPostLedgerEntryRejectsInvalidEntries(t *testing.T) {
+	setupTestDB(t)
+
+	userUUID := newTestUserUUID()
+
+	_, err := postWalletTransaction(userUUID, LedgerCredit, 0.001, "test-zero:"+userUUID, "Test")
+	if err == nil {
+		t.Error("posted an amount that rounds to zero")
+	}
+
+	_, err = postWalletTransaction(userUUID, "gift", 10, "test-type:"+userUUID, "Test")
+	if err == nil {
+		t.Error("posted an unknown entry type")
+	}
+}
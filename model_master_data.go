@@ -0,0 +1,560 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const (
+	MasterReligion   = "religion"
+	MasterCaste      = "caste"
+	MasterSubCaste   = "sub_caste"
+	MasterEducation  = "education"
+	MasterProfession = "profession"
+)
+
+// masterParentKinds gives the kind an item's parent must be. Kinds not listed
+// have no parent.
+var masterParentKinds = map[string]string{
+	MasterCaste:    MasterReligion,
+	MasterSubCaste: MasterCaste,
+}
+
+var masterCodeRegexp = regexp.MustCompile(`^[a-z0-9_]{1,64}$`)
+
+var masterSpaceRegexp = regexp.MustCompile(`[\s._\-/]+`)
+
+// MasterLabels holds the label of an item per language code.
+type MasterLabels map[string]string
+
+func (ml *MasterLabels) Scan(value interface{}) error {
+	asBytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+
+	err := json.Unmarshal(asBytes, &ml)
+
+	return err
+}
+
+func (ml MasterLabels) Value() (driver.Value, error) {
+	return json.Marshal(ml)
+}
+
+// MasterItem is an admin-managed reference value. Profiles store its Code;
+// Synonyms are the free-text spellings that resolve to it.
+type MasterItem struct {
+	Model
+
+	Kind     string         `gorm:"unique_index:idx_master_items_code" json:"kind"`
+	Code     string         `gorm:"unique_index:idx_master_items_code" json:"code"`
+	ParentID uint           `gorm:"index" json:"-"`
+	Labels   MasterLabels   `gorm:"type:jsonb" json:"labels"`
+	Synonyms pq.StringArray `gorm:"type:text[]" json:"synonyms"`
+	Position int            `json:"position"`
+	Active   bool           `json:"active"`
+
+	ParentCode string `gorm:"-" json:"parent"`
+}
+
+// MasterListItem is a master data value as served by listAPIHandler.
+type MasterListItem struct {
+	Label  string `json:"label"`
+	Value  string `json:"value"`
+	Parent string `json:"parent,omitempty"`
+}
+
+func getMasterKinds() []string {
+	return []string{MasterReligion, MasterCaste, MasterSubCaste, MasterEducation, MasterProfession}
+}
+
+// normalizeMasterText folds case, spacing and punctuation so that "Maratha",
+// " maratha" and "MARATHA" compare equal.
+func normalizeMasterText(s string) string {
+	return strings.TrimSpace(masterSpaceRegexp.ReplaceAllString(strings.ToLower(s), " "))
+}
+
+func (mi *MasterItem) label(lang string) string {
+	if l := mi.Labels[lang]; l != "" {
+		return l
+	}
+
+	return mi.Labels["en"]
+}
+
+func (mi *MasterItem) matches(value string) bool {
+	v := normalizeMasterText(value)
+	if v == "" {
+		return false
+	}
+
+	if v == normalizeMasterText(mi.Code) {
+		return true
+	}
+
+	for _, l := range mi.Labels {
+		if v == normalizeMasterText(l) {
+			return true
+		}
+	}
+
+	for _, s := range mi.Synonyms {
+		if v == normalizeMasterText(s) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (mi *MasterItem) sanitize() {
+	mi.Code = strings.ToLower(strings.TrimSpace(mi.Code))
+
+	labels := MasterLabels{}
+	for _, lang := range getSupportedLanguagesStrings() {
+		if l := sanitizeText(mi.Labels[lang], 100); l != "" {
+			labels[lang] = l
+		}
+	}
+	mi.Labels = labels
+
+	synonyms := make(pq.StringArray, 0, len(mi.Synonyms))
+	for _, s := range mi.Synonyms {
+		if s = normalizeMasterText(s); s != "" {
+			synonyms = append(synonyms, s)
+		}
+	}
+	mi.Synonyms = pq.StringArray(getUnique(synonyms))
+}
+
+func (mi *MasterItem) validate(ctx echo.Context) error {
+	if !isOneOf(mi.Kind, getMasterKinds()) {
+		return errors.New("Kind is invalid")
+	}
+
+	if !masterCodeRegexp.MatchString(mi.Code) {
+		return errors.New("Code must be lower case letters, digits and underscores")
+	}
+
+	if mi.Labels["en"] == "" {
+		return errors.New("An English label is required")
+	}
+
+	parentKind, ok := masterParentKinds[mi.Kind]
+	if !ok {
+		mi.ParentID = 0
+		return nil
+	}
+
+	var parent MasterItem
+
+	if mi.ParentCode == "" || db.Where("kind = ? AND code = ?", parentKind, mi.ParentCode).First(&parent).RecordNotFound() {
+		return errors.New("Parent " + strings.Replace(parentKind, "_", " ", -1) + " is required")
+	}
+
+	mi.ParentID = parent.ID
+
+	return nil
+}
+
+// masterCacheTTL bounds how long another server keeps serving a list after
+// an admin has changed it. Admin writes clear this server's cache at once.
+const masterCacheTTL = 5 * time.Minute
+
+type masterCacheEntry struct {
+	items    []MasterItem
+	loadedAt time.Time
+}
+
+// masterCache keeps the active items of each kind, as every search and
+// profile save resolves values against them.
+type masterCache struct {
+	sync.RWMutex
+	kinds map[string]masterCacheEntry
+}
+
+var masterItemsCache = masterCache{kinds: make(map[string]masterCacheEntry)}
+
+func (c *masterCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.kinds = make(map[string]masterCacheEntry)
+}
+
+// getMasterItems returns the active items of a kind with their parent codes.
+// The slice is shared and must not be changed.
+func getMasterItems(kind string) []MasterItem {
+	var mm []MasterItem
+
+	masterItemsCache.RLock()
+	e, ok := masterItemsCache.kinds[kind]
+	masterItemsCache.RUnlock()
+
+	if ok && time.Since(e.loadedAt) < masterCacheTTL {
+		return e.items
+	}
+
+	db.Where("kind = ? AND active = ?", kind, true).Order("position ASC, code ASC").Find(&mm)
+
+	setParentCodes(kind, mm)
+
+	masterItemsCache.Lock()
+	masterItemsCache.kinds[kind] = masterCacheEntry{items: mm, loadedAt: time.Now()}
+	masterItemsCache.Unlock()
+
+	return mm
+}
+
+func setParentCodes(kind string, mm []MasterItem) {
+	var parents []MasterItem
+
+	parentKind, ok := masterParentKinds[kind]
+	if !ok {
+		return
+	}
+
+	db.Where("kind = ?", parentKind).Find(&parents)
+
+	codes := make(map[uint]string, len(parents))
+	for _, p := range parents {
+		codes[p.ID] = p.Code
+	}
+
+	for i := range mm {
+		mm[i].ParentCode = codes[mm[i].ParentID]
+	}
+}
+
+func getMasterList(ctx echo.Context, kind string) []MasterListItem {
+	lang := getLanguageFromContext(ctx)
+
+	mm := getMasterItems(kind)
+	ll := make([]MasterListItem, 0, len(mm))
+
+	for _, m := range mm {
+		ll = append(ll, MasterListItem{Label: m.label(lang), Value: m.Code, Parent: m.ParentCode})
+	}
+
+	return ll
+}
+
+// resolveMasterValue maps free text to the code of an active item of kind.
+// The second result is false when the kind has items but none matches; a
+// kind nobody has configured accepts any value.
+func resolveMasterValue(kind string, value string, parentCode string) (string, bool) {
+	return matchMasterItem(getMasterItems(kind), value, parentCode)
+}
+
+func matchMasterItem(mm []MasterItem, value string, parentCode string) (string, bool) {
+	if strings.TrimSpace(value) == "" {
+		return "", true
+	}
+
+	if len(mm) == 0 {
+		return value, true
+	}
+
+	for _, m := range mm {
+		if m.matches(value) && (parentCode == "" || m.ParentCode == "" || m.ParentCode == parentCode) {
+			return m.Code, true
+		}
+	}
+
+	return value, false
+}
+
+// resolveMasterValues maps search filters to codes, keeping values that do
+// not resolve so free text saved before normalization can still be found.
+func resolveMasterValues(kind string, values []string) []string {
+	resolved := make([]string, 0, len(values))
+
+	for _, v := range values {
+		c, _ := resolveMasterValue(kind, v, "")
+		resolved = append(resolved, c)
+	}
+
+	return getUnique(resolved)
+}
+
+// resolveChangedMasterValue resolves value like resolveMasterValue, but a
+// value the profile already had is never rejected. Free text saved before the
+// lists existed, or pointing at an item deactivated since, is kept until
+// normalizeMasterData maps it.
+func resolveChangedMasterValue(kind string, value string, stored string, parentCode string) (string, bool) {
+	code, ok := resolveMasterValue(kind, value, parentCode)
+
+	return code, ok || value == stored
+}
+
+// normalizeMasterFields resolves the master data values of a profile being
+// saved and rejects changed ones that are not in the reference lists.
+func (u *User) normalizeMasterFields(ctx echo.Context) error {
+	var (
+		ok     bool
+		stored User
+	)
+
+	if u.ID != 0 {
+		db.Select("religion, caste, sub_caste, educational_info, career_info").Where("id = ?", u.ID).First(&stored)
+	}
+
+	u.Religion, ok = resolveChangedMasterValue(MasterReligion, u.Religion, stored.Religion, "")
+	if !ok {
+		return errors.New(gettext("Religion is invalid", ctx))
+	}
+
+	u.Caste, ok = resolveChangedMasterValue(MasterCaste, u.Caste, stored.Caste, u.Religion)
+	if !ok {
+		return errors.New(gettext("Caste is invalid", ctx))
+	}
+
+	u.SubCaste, ok = resolveChangedMasterValue(MasterSubCaste, u.SubCaste, stored.SubCaste, u.Caste)
+	if !ok {
+		return errors.New(gettext("Sub-caste is invalid", ctx))
+	}
+
+	u.EducationalInfo.Education, ok = resolveChangedMasterValue(MasterEducation, u.EducationalInfo.Education, stored.EducationalInfo.Education, "")
+	if !ok {
+		return errors.New(gettext("Education is invalid", ctx))
+	}
+
+	u.CareerInfo.Profession, ok = resolveChangedMasterValue(MasterProfession, u.CareerInfo.Profession, stored.CareerInfo.Profession, "")
+	if !ok {
+		return errors.New(gettext("Profession is invalid", ctx))
+	}
+
+	return nil
+}
+
+// seedMasterData adds the religions that used to be a fixed list, so the
+// hierarchy has roots to hang castes from.
+func seedMasterData() {
+	var count int
+
+	db.Model(&MasterItem{}).Where("kind = ?", MasterReligion).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	religions := [][]string{
+		{"hindu", "Hindu", "हिंदू", "हिंदू"},
+		{"muslim", "Muslim", "मुस्लिम", "मुस्लिम"},
+		{"christian", "Christian", "ईसाई", "ख्रिश्चन"},
+		{"sikh", "Sikh", "सिख", "शीख"},
+		{"buddhist", "Buddhist", "बौद्ध", "बौद्ध"},
+		{"jain", "Jain", "जैन", "जैन"},
+		{"parsi", "Parsi", "पारसी", "पारशी"},
+		{"jewish", "Jewish", "यहूदी", "ज्यू"},
+		{"none", "No religion", "कोई धर्म नहीं", "धर्म नाही"},
+		{"other", "Other", "अन्य", "इतर"},
+	}
+
+	for i, r := range religions {
+		db.Create(&MasterItem{
+			Kind:     MasterReligion,
+			Code:     r[0],
+			Labels:   MasterLabels{"en": r[1], "hi": r[2], "mr": r[3]},
+			Synonyms: pq.StringArray{},
+			Position: i,
+			Active:   true,
+		})
+	}
+
+	masterItemsCache.clear()
+}
+
+// normalizeMasterData maps the free text saved in profiles to master data
+// codes. It is run by an admin once the reference lists and synonyms are in
+// place, and can be run again after adding synonyms for what is left.
+// Profiles saved before professions were typed only have the free-text job
+// title, which is used to fill the profession in.
+func normalizeMasterData() (int, map[string]map[string]int) {
+	var uu []User
+
+	mapped := 0
+	unmapped := map[string]map[string]int{}
+
+	items := map[string][]MasterItem{}
+	for _, kind := range getMasterKinds() {
+		items[kind] = getMasterItems(kind)
+	}
+
+	note := func(kind string, value string) {
+		if unmapped[kind] == nil {
+			unmapped[kind] = map[string]int{}
+		}
+
+		unmapped[kind][value]++
+	}
+
+	db.Unscoped().Select("id, religion, caste, sub_caste, educational_info, career_info, job_title").Find(&uu)
+
+	for _, u := range uu {
+		updates := map[string]interface{}{}
+
+		religion, ok := matchMasterItem(items[MasterReligion], u.Religion, "")
+		if !ok {
+			note(MasterReligion, u.Religion)
+		} else if religion != u.Religion {
+			updates["religion"] = religion
+		}
+
+		caste, ok := matchMasterItem(items[MasterCaste], u.Caste, religion)
+		if !ok {
+			note(MasterCaste, u.Caste)
+		} else if caste != u.Caste {
+			updates["caste"] = caste
+		}
+
+		subCaste, ok := matchMasterItem(items[MasterSubCaste], u.SubCaste, caste)
+		if !ok {
+			note(MasterSubCaste, u.SubCaste)
+		} else if subCaste != u.SubCaste {
+			updates["sub_caste"] = subCaste
+		}
+
+		education, ok := matchMasterItem(items[MasterEducation], u.EducationalInfo.Education, "")
+		if !ok {
+			note(MasterEducation, u.EducationalInfo.Education)
+		} else if education != u.EducationalInfo.Education {
+			u.EducationalInfo.Education = education
+			updates["educational_info"] = u.EducationalInfo
+		}
+
+		value := u.CareerInfo.Profession
+		if value == "" && len(items[MasterProfession]) > 0 {
+			value = u.JobTitle
+		}
+
+		profession, ok := matchMasterItem(items[MasterProfession], value, "")
+		if !ok {
+			note(MasterProfession, value)
+		} else if profession != u.CareerInfo.Profession {
+			u.CareerInfo.Profession = profession
+			updates["career_info"] = u.CareerInfo
+		}
+
+		if len(updates) > 0 {
+			db.Unscoped().Model(&User{}).Where("id = ?", u.ID).UpdateColumns(updates)
+			mapped++
+		}
+	}
+
+	return mapped, unmapped
+}
+
+func adminMasterDataHandler(ctx echo.Context) error {
+	kind := ctx.QueryParam("kind")
+	if !isOneOf(kind, getMasterKinds()) {
+		return ctx.JSON(http.StatusBadRequest, "Kind is invalid")
+	}
+
+	var mm []MasterItem
+
+	db.Where("kind = ?", kind).Order("position ASC, code ASC").Find(&mm)
+
+	setParentCodes(kind, mm)
+
+	return ctx.JSON(http.StatusOK, mm)
+}
+
+func adminCreateMasterItemHandler(ctx echo.Context) error {
+	var mi MasterItem
+
+	err := ctx.Bind(&mi)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	mi.zeroID()
+	mi.sanitize()
+
+	err = mi.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	err = db.Create(&mi).Error
+	if err != nil {
+		return ctx.JSON(http.StatusConflict, "An item with this code already exists")
+	}
+
+	masterItemsCache.clear()
+
+	return ctx.JSON(http.StatusCreated, mi)
+}
+
+func adminUpdateMasterItemHandler(ctx echo.Context) error {
+	var mi MasterItem
+
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&mi).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	// Profiles store the code, so it and the kind cannot change
+	id, uuid, kind, code := mi.ID, mi.UUID, mi.Kind, mi.Code
+
+	// Load the parent so a request that leaves it out keeps it
+	mm := []MasterItem{mi}
+	setParentCodes(mi.Kind, mm)
+	mi = mm[0]
+
+	err := ctx.Bind(&mi)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	mi.ID, mi.UUID, mi.Kind, mi.Code = id, uuid, kind, code
+	mi.sanitize()
+
+	err = mi.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	err = db.Save(&mi).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, "Unable to save item")
+	}
+
+	masterItemsCache.clear()
+
+	return ctx.JSON(http.StatusOK, mi)
+}
+
+func adminNormalizeMasterDataHandler(ctx echo.Context) error {
+	type unmappedValue struct {
+		Value string `json:"value"`
+		Count int    `json:"count"`
+	}
+
+	mapped, unmapped := normalizeMasterData()
+
+	resp := map[string][]unmappedValue{}
+	for kind, values := range unmapped {
+		for v, c := range values {
+			resp[kind] = append(resp[kind], unmappedValue{Value: v, Count: c})
+		}
+
+		sort.Slice(resp[kind], func(i, j int) bool {
+			return resp[kind][i].Count > resp[kind][j].Count
+		})
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"profiles_updated": mapped,
+		"unmapped":         resp,
+	})
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lib/pq"
+)
+
+func TestNormalizeMasterText(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"B.Tech", "b tech"},
+		{"  B. Tech  ", "b tech"},
+		{"b_tech", "b tech"},
+		{"M.B.B.S.", "m b b s"},
+		{"Software-Engineer", "software engineer"},
+		{"IT / Software", "it software"},
+		{"ब्राह्मण", "ब्राह्मण"},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := normalizeMasterText(tt.s); got != tt.want {
+			t.Errorf("normalizeMasterText(%q) = %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestMatchMasterItem(t *testing.T) {
+	castes := []MasterItem{
+		{Code: "brahmin", ParentCode: "hindu", Labels: MasterLabels{"en": "Brahmin", "hi": "ब्राह्मण"}, Synonyms: pq.StringArray{"bramhan", "brahman"}},
+		{Code: "maratha", ParentCode: "hindu", Labels: MasterLabels{"en": "Maratha"}, Synonyms: pq.StringArray{}},
+		{Code: "sunni", ParentCode: "muslim", Labels: MasterLabels{"en": "Sunni"}, Synonyms: pq.StringArray{}},
+		{Code: "other", Labels: MasterLabels{"en": "Other"}, Synonyms: pq.StringArray{}},
+	}
+
+	tests := []struct {
+		name   string
+		items  []MasterItem
+		value  string
+		parent string
+		code   string
+		ok     bool
+	}{
+		{"code", castes, "brahmin", "", "brahmin", true},
+		{"label in another case", castes, "BRAHMIN", "", "brahmin", true},
+		{"translated label", castes, "ब्राह्मण", "", "brahmin", true},
+		{"synonym", castes, " Bramhan ", "", "brahmin", true},
+		{"matching parent", castes, "Maratha", "hindu", "maratha", true},
+		{"other parent", castes, "Sunni", "hindu", "Sunni", false},
+		{"item without a parent", castes, "Other", "muslim", "other", true},
+		{"unknown", castes, "Kshatriya", "", "Kshatriya", false},
+		{"empty", castes, "  ", "", "", true},
+		// Before an admin adds a list, free text is kept
+		{"no list", nil, "Kshatriya", "", "Kshatriya", true},
+	}
+
+	for _, tt := range tests {
+		code, ok := matchMasterItem(tt.items, tt.value, tt.parent)
+		if code != tt.code || ok != tt.ok {
+			t.Errorf("%s: matchMasterItem(%q, %q) = %q, %v, want %q, %v", tt.name, tt.value, tt.parent, code, ok, tt.code, tt.ok)
+		}
+	}
+}
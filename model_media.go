@@ -1,193 +1,701 @@
 package main
 
 import (
-	"bytes"
-	"fmt"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
 	"io/ioutil"
 	"log"
-	"mime"
-	"mime/multipart"
 	"net/http"
 	"os"
-	"path/filepath"
-	"io"
+	"path"
+	"strconv"
+	"strings"
 
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/jinzhu/gorm"
 	"github.com/labstack/echo"
 	uuid "github.com/satori/go.uuid"
 )
 
+// maxRenditionAttempts is how often generateMissingRenditions tries a photo
+// before giving up on it, e.g. a WebP upload or a missing blob, so such
+// photos do not hold up the rest.
+const maxRenditionAttempts = 3
+
+const (
+	MediaPending  = "pending"
+	MediaApproved = "approved"
+	MediaRejected = "rejected"
+)
+
+const (
+	MediaProfile    = "profile"
+	MediaHoroscope  = "horoscope"
+	MediaIDDocument = "id_document"
+)
+
+// Media is a photo uploaded by a member. Path and the rendition paths are
+// keys in the blob store, never public URLs. Other members only see
+// approved photos.
 type Media struct {
 	Model
-	UserUUID string `gorm:"type:uuid;index;" json:"user_uuid"`
-	Name     string `json:"name"`
-	Path     string `json:"path"`
-	Type     string `json:"type"`
+	UserUUID      string `gorm:"type:uuid;index;" json:"user_uuid"`
+	Name          string `json:"name"`
+	Path          string `json:"-"`
+	ThumbnailPath string `json:"-"`
+	CardPath      string `json:"-"`
+	FullPath      string `json:"-"`
+	Type          string `json:"type"`
+	Caption       string `json:"caption"`
+	Position      int    `json:"position"`
+	IsPrimary     bool   `json:"is_primary"`
+	Width         int    `json:"width"`
+	Height        int    `json:"height"`
+
+	// RenditionAttempts counts failed runs of generateMissingRenditions
+	RenditionAttempts int `gorm:"not null;default:0" json:"-"`
+
+	Status          string       `gorm:"index" json:"status"`
+	RejectionReason string       `json:"rejection_reason"`
+	ModeratedBy     string       `json:"-"`
+	ModeratedAt     sql.NullTime `json:"-"`
+
+	URL          string `gorm:"-" json:"url"`
+	ThumbnailURL string `gorm:"-" json:"thumbnail_url"`
+	CardURL      string `gorm:"-" json:"card_url"`
+	FullURL      string `gorm:"-" json:"full_url"`
 }
 
-func upload(ctx echo.Context) error {
-	u, err := verifySession(ctx)
-	if err != nil {
-		return ctx.JSON(http.StatusUnauthorized, err.Error())
+var mediaExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+
+	"application/pdf": ".pdf",
+}
+
+func getMediaTypes() []string {
+	return []string{MediaProfile, MediaHoroscope, MediaIDDocument}
+}
+
+// getMediaMaxCount returns how many files a member may keep in their album.
+func getMediaMaxCount() int {
+	count, err := strconv.Atoi(os.Getenv("VM_MEDIA_MAX_COUNT"))
+	if err != nil || count <= 0 {
+		count = 10
 	}
 
-	filetype := ctx.Param("type")
-	UUID := ctx.Param("uuid")
+	return count
+}
 
-	var (
-		m  Media
-		m2 Media
-	)
-	m.UserUUID = u.UUID
-	m.Type = filetype
+func getMediaMaxSize() int64 {
+	size, err := strconv.ParseInt(os.Getenv("VM_MEDIA_MAX_SIZE"), 10, 64)
+	if err != nil || size <= 0 {
+		size = 10 << 20
+	}
+
+	return size
+}
+
+// getMediaKey names a file after its content so identical uploads share a
+// key and a key never points to different content.
+func getMediaKey(data []byte, ext string) string {
+	sum := sha256.Sum256(data)
+
+	return "media/" + hex.EncodeToString(sum[:]) + ext
+}
+
+func getRenditionKey(key string, rendition string) string {
+	ext := path.Ext(key)
+
+	return strings.TrimSuffix(key, ext) + "_" + rendition + ext
+}
+
+func getMediaContentType(key string) string {
+	for t, ext := range mediaExtensions {
+		if strings.HasSuffix(key, ext) {
+			return t
+		}
+	}
+
+	return "application/octet-stream"
+}
+
+// AfterFind issues short lived URLs for the file and its renditions. Only
+// media the member may see must be loaded: profile cards filter by
+// moderation state and privacy settings before returning photos.
+func (m *Media) AfterFind() error {
+	m.URL = m.signURL("")
+	m.ThumbnailURL = m.signURL(RenditionThumbnail)
+	m.CardURL = m.signURL(RenditionCard)
+	m.FullURL = m.signURL(RenditionFull)
+
+	return nil
+}
 
-	// Parsing UUID from string input
-	u2, err := uuid.FromString(UUID)
+func (m *Media) signURL(rendition string) string {
+	if m.Path == "" {
+		return ""
+	}
+
+	// Files uploaded before the blob store that could not be migrated
+	if isLegacyMediaPath(m.Path) {
+		return m.Path
+	}
+
+	u, err := blobStore.url(m.getKey(rendition), getBlobURLTTL())
 	if err != nil {
-		fmt.Printf("Something went wrong: %s", err)
-		// return ctx.JSON(http.StatusBadRequest, err.Error())
-		u2 = uuid.NewV4() // generate new valid uuid
+		log.Println("Error while signing media URL: ", err.Error())
+		return ""
 	}
 
-	m.UUID = u2.String()
+	return u
+}
 
-	db.Model(&Media{}).Where("uuid = ?", m.UUID).First(&m2)
+// canViewMedia decides whether a member may see another member's photo.
+func canViewMedia(viewer User, m Media) bool {
+	var owner User
 
-	if m2.ID > 0 {
-		m.ID = m2.ID
+	if m.UserUUID == viewer.UUID {
+		return true
 	}
 
-	// Multipart form
-	form, err := ctx.MultipartForm()
+	if m.Status != MediaApproved || m.Type == MediaIDDocument || isBlocked(viewer.UUID, m.UserUUID) {
+		return false
+	}
+
+	if db.Where("uuid = ?", m.UserUUID).First(&owner).RecordNotFound() {
+		return false
+	}
+
+	return !getProfileCard(viewer.UUID, owner).PhotosHidden
+}
+
+// getKey returns the blob key of a rendition, or of the original when the
+// rendition is unknown or not generated yet.
+func (m *Media) getKey(rendition string) string {
+	var key string
+
+	switch rendition {
+	case RenditionThumbnail:
+		key = m.ThumbnailPath
+	case RenditionCard:
+		key = m.CardPath
+	case RenditionFull:
+		key = m.FullPath
+	}
+
+	if key == "" {
+		key = m.Path
+	}
+
+	return key
+}
+
+// setImage stores a processed image and its renditions and points the media
+// at them.
+func (m *Media) setImage(p *ProcessedImage) error {
+	key := getMediaKey(p.Original, p.Ext)
+
+	err := blobStore.put(key, p.Original, p.ContentType)
 	if err != nil {
 		return err
 	}
-	files := form.File["pics"]
-	for _, file := range files {
-		// Create a single AWS session (we can re use this if we're uploading many files)
-		/*s,*/_, err := session.NewSession(&aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))})
-		if err != nil {
-			log.Fatal(err)
-		}
 
-		//upload to public/pictures
-		src, err := file.Open()
+	keys := map[string]string{}
+	for _, r := range getRenditions() {
+		keys[r] = getRenditionKey(key, r)
+
+		err = blobStore.put(keys[r], p.Renditions[r], p.ContentType)
 		if err != nil {
 			return err
 		}
-		
-	
-		// Destination
-		dst, err := os.Create("public/pictures/"+file.Filename)
+	}
+
+	m.Path = key
+	m.ThumbnailPath = keys[RenditionThumbnail]
+	m.CardPath = keys[RenditionCard]
+	m.FullPath = keys[RenditionFull]
+	m.Width = p.Width
+	m.Height = p.Height
+
+	return nil
+}
+
+// deleteBlobsIfUnused removes the files of a media once no media row points
+// to them. Renditions share the fate of their original.
+func deleteBlobsIfUnused(old Media) {
+	var count int
+
+	if old.Path == "" || isLegacyMediaPath(old.Path) {
+		return
+	}
+
+	db.Unscoped().Model(&Media{}).Where("path = ?", old.Path).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	for _, key := range []string{old.Path, old.ThumbnailPath, old.CardPath, old.FullPath} {
+		if key == "" {
+			continue
+		}
+
+		err := blobStore.delete(key)
 		if err != nil {
-			return err
+			log.Println("Error while deleting blob: ", err.Error())
 		}
-	// Copy
-		if _, err = io.Copy(dst, src); err != nil {
-			return err
+	}
+}
+
+func isLegacyMediaPath(p string) bool {
+	return strings.HasPrefix(p, "http://") || strings.HasPrefix(p, "https://")
+}
+
+func upload(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var m Media
+
+	if !isOneOf(ctx.Param("type"), getMediaTypes()) {
+		return ctx.JSON(http.StatusBadRequest, gettext("Media type is invalid", ctx))
+	}
+
+	// Uploading with the UUID of an existing file replaces it, any other UUID
+	// adds a new file
+	if _, err := uuid.FromString(ctx.Param("uuid")); err == nil && !db.Where("uuid = ?", ctx.Param("uuid")).First(&m).RecordNotFound() {
+		if m.UserUUID != u.UUID {
+			return ctx.NoContent(http.StatusNotFound)
 		}
+	} else {
+		var count int
 
-		defer dst.Close()
-		defer src.Close()
-	
-		// Upload to s3
-		// m.Path, err = AddFileToS3(s, m.UUID, file)
-		// if err != nil {
-		// 	log.Fatal(err)
-		// 	return ctx.JSON(http.StatusBadRequest, err.Error())
-		// }
+		db.Model(&Media{}).Where("user_uuid = ?", u.UUID).Count(&count)
+		if count >= getMediaMaxCount() {
+			return ctx.JSON(http.StatusConflict, gettext("You have reached the maximum number of photos", ctx))
+		}
 
-		// m.Name = file.Filename
-		// m.Path = "https://vm-pictures.s3.ap-south-1.amazonaws.com/pictures/" + m.Path
+		m = Media{UserUUID: u.UUID, Position: count}
+	}
 
-		m.Path = "https://marriage-era.com/pictures/"+file.Filename
+	m.Type = ctx.Param("type")
 
-		db.Save(&m)
+	form, err := ctx.MultipartForm()
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	files := form.File["pics"]
+	if len(files) == 0 {
+		return ctx.JSON(http.StatusBadRequest, gettext("File is required", ctx))
+	}
 
+	file := files[0]
+	if file.Size > getMediaMaxSize() {
+		return ctx.JSON(http.StatusRequestEntityTooLarge, gettext("File is too large", ctx))
 	}
-	// db.Where("from_user_uuid = ?", u.UUID).Find(&uu)
+
+	src, err := file.Open()
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	defer src.Close()
+
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	p, err := processImage(data)
+	switch err {
+	case nil:
+	case errImageTooSmall:
+		return ctx.JSON(http.StatusBadRequest, gettext("Image is too small", ctx))
+	case errImageTooLarge:
+		return ctx.JSON(http.StatusBadRequest, gettext("Image dimensions are too large", ctx))
+	default:
+		return ctx.JSON(http.StatusUnsupportedMediaType, gettext("Unsupported file type", ctx))
+	}
+
+	old := m
+
+	err = m.setImage(p)
+	if err != nil {
+		log.Println("Error while storing media: ", err.Error())
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to upload file", ctx))
+	}
+
+	m.Name = sanitizeText(path.Base(file.Filename), 255)
+
+	if caption, ok := form.Value["caption"]; ok && len(caption) > 0 {
+		m.Caption = sanitizeText(caption[0], 200)
+	}
+
+	if m.Type != MediaProfile {
+		m.IsPrimary = false
+	}
+
+	// Every new picture goes back to the moderation queue
+	m.Status = MediaPending
+	m.RejectionReason = ""
+	m.ModeratedBy = ""
+	m.ModeratedAt = sql.NullTime{}
+
+	err = db.Save(&m).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to upload file", ctx))
+	}
+
+	if old.Path != m.Path {
+		go deleteBlobsIfUnused(old)
+
+		// The photo verified by a selfie is gone
+		if old.IsPrimary {
+			revokeBadge(u.UUID, BadgePhoto)
+		}
+	}
+
+	ensurePrimaryMedia(u.UUID)
+	db.Where("id = ?", m.ID).First(&m)
 
 	return ctx.JSON(http.StatusCreated, m)
 }
 
 func download(ctx echo.Context) error {
-
-	_, err := verifySession(ctx)
+	u, err := verifySession(ctx)
 	if err != nil {
 		return ctx.JSON(http.StatusUnauthorized, err.Error())
 	}
 
 	var m Media
-	UUID := ctx.Param("uuid")
-	log.Println(UUID)
 
-	err = db.Model(&Media{}).Where("uuid = ?", UUID).First(&m).Error
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&m).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if !canViewMedia(u, m) {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	// The file itself is served by the storage backend
+	url := m.signURL(ctx.QueryParam("size"))
+	if url == "" {
+		return ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	return ctx.Redirect(http.StatusFound, url)
+}
+
+// ensurePrimaryMedia makes the first profile photo primary when a member has
+// none, e.g. after the primary photo was deleted.
+func ensurePrimaryMedia(userUUID string) {
+	var (
+		m     Media
+		count int
+	)
+
+	db.Model(&Media{}).Where("user_uuid = ? AND is_primary = ?", userUUID, true).Count(&count)
+	if count > 0 {
+		return
+	}
+
+	if db.Where("user_uuid = ? AND type = ?", userUUID, MediaProfile).Order("position ASC, id ASC").First(&m).RecordNotFound() {
+		return
+	}
+
+	db.Model(&Media{}).Where("id = ?", m.ID).UpdateColumn("is_primary", true)
+}
+
+// getOwnMedia finds one of the member's files by UUID.
+func getOwnMedia(ctx echo.Context, u User) (Media, bool) {
+	var m Media
+
+	found := !db.Where("uuid = ? AND user_uuid = ?", ctx.Param("uuid"), u.UUID).First(&m).RecordNotFound()
+
+	return m, found
+}
+
+func album(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	mm := []Media{}
+
+	db.Where("user_uuid = ?", u.UUID).Order("is_primary DESC, position ASC, id ASC").Find(&mm)
 
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"media": mm,
+		"limit": getMediaMaxCount(),
+	})
+}
+
+func updateMedia(ctx echo.Context) error {
+	var data struct {
+		Caption *string `json:"caption"`
+		Type    *string `json:"type"`
+	}
+
+	u, err := verifySession(ctx)
 	if err != nil {
-		log.Println(err.Error())
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	m, found := getOwnMedia(ctx, u)
+	if !found {
 		return ctx.NoContent(http.StatusNotFound)
 	}
 
-	resp, err := http.Get(m.Path)
+	err = ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	updates := map[string]interface{}{}
+
+	if data.Caption != nil {
+		updates["caption"] = sanitizeText(*data.Caption, 200)
+	}
+
+	if data.Type != nil {
+		if !isOneOf(*data.Type, getMediaTypes()) {
+			return ctx.JSON(http.StatusBadRequest, gettext("Media type is invalid", ctx))
+		}
+
+		updates["type"] = *data.Type
 
+		if *data.Type != MediaProfile {
+			updates["is_primary"] = false
+
+			if m.IsPrimary {
+				revokeBadge(u.UUID, BadgePhoto)
+			}
+		}
+	}
+
+	if len(updates) > 0 {
+		err = db.Model(&m).Updates(updates).Error
+		if err != nil {
+			return ctx.JSON(http.StatusInternalServerError, gettext("Unable to save photo", ctx))
+		}
+
+		ensurePrimaryMedia(u.UUID)
+	}
+
+	db.Where("id = ?", m.ID).First(&m)
+
+	return ctx.JSON(http.StatusOK, m)
+}
+
+func deleteMedia(ctx echo.Context) error {
+	u, err := verifySession(ctx)
 	if err != nil {
-		return err
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
 	}
 
-	defer resp.Body.Close()
+	m, found := getOwnMedia(ctx, u)
+	if !found {
+		return ctx.NoContent(http.StatusNotFound)
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("Status error: %v", resp.StatusCode)
+	// Removed photos are deleted for good, not kept behind a deleted_at
+	err = db.Unscoped().Delete(&m).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to delete photo", ctx))
 	}
-	data, _ := ioutil.ReadAll(resp.Body)
-	return ctx.Blob(http.StatusOK, mime.TypeByExtension(filepath.Ext(m.Path)), data)
 
+	go deleteBlobsIfUnused(m)
+
+	if m.IsPrimary {
+		revokeBadge(u.UUID, BadgePhoto)
+	}
+
+	ensurePrimaryMedia(u.UUID)
+
+	return ctx.NoContent(http.StatusNoContent)
 }
 
-// AddFileToS3 will upload a single file to S3, it will require a pre-built aws session
-// and will set file info like content type and encryption on the uploaded file.
-func AddFileToS3(s *session.Session, uuid string, file *multipart.FileHeader) (string, error) {
+func setPrimaryMedia(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	m, found := getOwnMedia(ctx, u)
+	if !found {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if m.Type != MediaProfile {
+		return ctx.JSON(http.StatusBadRequest, gettext("Only a profile photo can be the primary photo", ctx))
+	}
+
+	tx := db.Begin()
+
+	err = tx.Model(&Media{}).Where("user_uuid = ? AND id <> ?", u.UUID, m.ID).UpdateColumn("is_primary", false).Error
+	if err == nil {
+		err = tx.Model(&Media{}).Where("id = ?", m.ID).UpdateColumn("is_primary", true).Error
+	}
 
-	src, err := file.Open()
 	if err != nil {
-		return "", err
+		tx.Rollback()
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to save photo", ctx))
 	}
-	defer src.Close()
 
-	// // Open the file for use
-	// file, err := os.Open(fileDir)
-	// if err != nil {
-	// 	return err
-	// }
-	// defer file.Close()
-
-	// Get file size and read the file content into a buffer
-	var size int64 = file.Size
-	buffer := make([]byte, size)
-	src.Read(buffer)
-
-	// create a unique file name for the file
-	tempFileName := "pictures/" + uuid + filepath.Ext(file.Filename)
-
-	// Config settings: this is where you choose the bucket, filename, content-type etc.
-	// of the file you're uploading.
-	_, err = s3.New(s).PutObject(&s3.PutObjectInput{
-		Bucket:               aws.String(os.Getenv("AWS_S3_BUCKET")),
-		Key:                  aws.String(tempFileName),
-		ACL:                  aws.String("public-read"),
-		Body:                 bytes.NewReader(buffer),
-		ContentLength:        aws.Int64(size),
-		ContentType:          aws.String(http.DetectContentType(buffer)),
-		ContentDisposition:   aws.String("attachment"),
-		ServerSideEncryption: aws.String("AES256"),
-	})
+	tx.Commit()
+
+	// A selfie only verifies the photo it was compared with
+	if !m.IsPrimary {
+		revokeBadge(u.UUID, BadgePhoto)
+	}
+
+	m.IsPrimary = true
+
+	return ctx.JSON(http.StatusOK, m)
+}
+
+func reorderMedia(ctx echo.Context) error {
+	var data struct {
+		UUIDs []string `json:"uuids"`
+	}
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
 
+	err = ctx.Bind(&data)
 	if err != nil {
-		log.Println(err.Error)
-		return "", err
+		return returnInvalidData(ctx, err)
+	}
+
+	var count int
+
+	data.UUIDs = getUnique(data.UUIDs)
+
+	db.Model(&Media{}).Where("user_uuid = ? AND uuid IN (?)", u.UUID, data.UUIDs).Count(&count)
+	if len(data.UUIDs) == 0 || count != len(data.UUIDs) {
+		return ctx.JSON(http.StatusBadRequest, gettext("Photos are invalid", ctx))
 	}
 
-	return tempFileName, err
+	tx := db.Begin()
+
+	for i, id := range data.UUIDs {
+		err = tx.Model(&Media{}).Where("uuid = ? AND user_uuid = ?", id, u.UUID).UpdateColumn("position", i).Error
+		if err != nil {
+			tx.Rollback()
+			return ctx.JSON(http.StatusInternalServerError, gettext("Unable to save photos", ctx))
+		}
+	}
+
+	tx.Commit()
+
+	return album(ctx)
+}
+
+// migrateMediaPaths moves files that were written to public/pictures into the
+// blob store and replaces their public URLs with keys.
+func migrateMediaPaths() {
+	var mm []Media
+
+	db.Unscoped().Where("path LIKE ?", "http%").Find(&mm)
+
+	for _, m := range mm {
+		data, err := ioutil.ReadFile("public/pictures/" + path.Base(m.Path))
+		if err != nil {
+			continue
+		}
+
+		ext, ok := mediaExtensions[http.DetectContentType(data)]
+		if !ok {
+			continue
+		}
+
+		key := getMediaKey(data, ext)
+
+		err = blobStore.put(key, data, http.DetectContentType(data))
+		if err != nil {
+			log.Println("Error while migrating media: ", err.Error())
+			continue
+		}
+
+		db.Unscoped().Model(&Media{}).Where("id = ?", m.ID).Updates(map[string]interface{}{"path": key})
+	}
+}
+
+// generateMissingRenditions processes photos stored before uploads were
+// resized, replacing the original with a copy without metadata.
+func generateMissingRenditions() {
+	var mm []Media
+
+	db.Where("thumbnail_path = '' OR thumbnail_path IS NULL").Where("path NOT LIKE ?", "http%").
+		Where("rendition_attempts < ?", maxRenditionAttempts).Order("id ASC").Limit(100).Find(&mm)
+
+	failed := func(m Media) {
+		db.Model(&Media{}).Where("id = ?", m.ID).UpdateColumn("rendition_attempts", gorm.Expr("rendition_attempts + 1"))
+	}
+
+	for _, m := range mm {
+		r, err := blobStore.get(m.Path)
+		if err != nil {
+			failed(m)
+			continue
+		}
+
+		data, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			failed(m)
+			continue
+		}
+
+		p, err := processImage(data)
+		if err != nil {
+			log.Println("Unable to process media ", m.UUID, ": ", err.Error())
+			failed(m)
+			continue
+		}
+
+		old := m
+
+		err = m.setImage(p)
+		if err != nil {
+			log.Println("Error while storing media: ", err.Error())
+			failed(m)
+			continue
+		}
+
+		db.Model(&Media{}).Where("id = ?", m.ID).Updates(map[string]interface{}{
+			"path":           m.Path,
+			"thumbnail_path": m.ThumbnailPath,
+			"card_path":      m.CardPath,
+			"full_path":      m.FullPath,
+			"width":          m.Width,
+			"height":         m.Height,
+		})
+
+		if old.Path != m.Path {
+			deleteBlobsIfUnused(old)
+		}
+	}
+}
+
+// migrateMediaStatuses approves the photos that were live before moderation.
+func migrateMediaStatuses() {
+	db.Exec("UPDATE media SET status = ? WHERE COALESCE(status, '') = ''", MediaApproved)
+}
+
+// migrateMediaTypes files legacy uploads under profile photos and picks a
+// primary photo for members who have none.
+func migrateMediaTypes() {
+	db.Exec("UPDATE media SET type = ? WHERE COALESCE(type, '') NOT IN (?)", MediaProfile, getMediaTypes())
+	db.Exec(`UPDATE media SET is_primary = true WHERE id IN (
+		SELECT DISTINCT ON (user_uuid) id FROM media WHERE type = ? AND deleted_at IS NULL ORDER BY user_uuid, position, id
+	) AND user_uuid NOT IN (SELECT user_uuid FROM media WHERE is_primary)`, MediaProfile)
 }
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	MessageFlagAbuse   = "abuse"
+	MessageFlagContact = "contact_details"
+	MessageFlagScam    = "scam"
+)
+
+type Message struct {
+	Model
+
+	ConversationID uint         `gorm:"index" json:"-"`
+	SenderUUID     string       `gorm:"type:uuid;index" json:"sender_uuid"`
+	Body           string       `json:"body"`
+	ReadAt         sql.NullTime `json:"read_at"`
+	Flagged        bool         `gorm:"index" json:"-"`
+	FlagReason     string       `json:"-"`
+}
+
+var (
+	messagePhoneRegexp = regexp.MustCompile(`\+?\d[\d\s-]{8,}\d`)
+	messageEmailRegexp = regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`)
+)
+
+// getMessageKeywords reads a comma separated list of keywords, skipping
+// blank entries.
+func getMessageKeywords(env string, defaults []string) []string {
+	if os.Getenv(env) == "" {
+		return defaults
+	}
+
+	ww := []string{}
+	for _, w := range strings.Split(strings.ToLower(os.Getenv(env)), ",") {
+		if w = strings.TrimSpace(w); w != "" {
+			ww = append(ww, w)
+		}
+	}
+
+	return ww
+}
+
+// isWordRune includes marks, which carry the vowel signs of Devanagari.
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsMark(r) || unicode.IsNumber(r)
+}
+
+// containsWord reports whether w appears in s as whole words, so that
+// "class" does not match "ass".
+func containsWord(s string, w string) bool {
+	for i := 0; i < len(s); {
+		j := strings.Index(s[i:], w)
+		if j < 0 {
+			return false
+		}
+
+		start, end := i+j, i+j+len(w)
+
+		before, _ := utf8.DecodeLastRuneInString(s[:start])
+		after, _ := utf8.DecodeRuneInString(s[end:])
+		if !isWordRune(before) && !isWordRune(after) {
+			return true
+		}
+
+		_, size := utf8.DecodeRuneInString(s[start:])
+		i = start + size
+	}
+
+	return false
+}
+
+// getMessageFlag returns why a message should be reviewed by moderation, or an
+// empty string if it looks fine.
+func getMessageFlag(body string) string {
+	lower := strings.ToLower(body)
+
+	for _, w := range getMessageKeywords("VM_MESSAGE_ABUSE_WORDS", []string{"idiot", "stupid", "bastard", "bitch", "fuck", "slut"}) {
+		if containsWord(lower, w) {
+			return MessageFlagAbuse
+		}
+	}
+
+	for _, w := range getMessageKeywords("VM_MESSAGE_SCAM_WORDS", []string{"send money", "bank account", "gift card", "western union", "customs fee", "upi id"}) {
+		if containsWord(lower, w) {
+			return MessageFlagScam
+		}
+	}
+
+	if messagePhoneRegexp.MatchString(body) || messageEmailRegexp.MatchString(body) {
+		return MessageFlagContact
+	}
+
+	for _, w := range []string{"whatsapp", "telegram", "instagram", "snapchat"} {
+		if containsWord(lower, w) {
+			return MessageFlagContact
+		}
+	}
+
+	return ""
+}
+
+func messages(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	c, err := getConversation(ctx.Param("uuid"), u.UUID)
+	if err != nil {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	limit, err := strconv.Atoi(ctx.QueryParam("limit"))
+	if err != nil || limit <= 0 || limit > 50 {
+		limit = 30
+	}
+
+	var mm []Message
+
+	dbQuery := db.Where("conversation_id = ?", c.ID)
+
+	// Older pages are requested with the UUID of the oldest message loaded
+	if before := ctx.QueryParam("before"); before != "" {
+		var m Message
+		if db.Where("uuid = ? AND conversation_id = ?", before, c.ID).First(&m).RecordNotFound() {
+			return ctx.NoContent(http.StatusNotFound)
+		}
+
+		dbQuery = dbQuery.Where("id < ?", m.ID)
+	}
+
+	dbQuery.Order("id DESC").Limit(limit).Find(&mm)
+
+	return ctx.JSON(http.StatusOK, mm)
+}
+
+func sendMessage(ctx echo.Context) error {
+	var data struct {
+		Body string `json:"body"`
+	}
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	c, err := getConversation(ctx.Param("uuid"), u.UUID)
+	if err != nil {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	to := c.getOtherUUID(u.UUID)
+
+	err = canMessage(ctx, u.UUID, to)
+	if err != nil {
+		return ctx.JSON(http.StatusForbidden, err.Error())
+	}
+
+	m := Message{
+		ConversationID: c.ID,
+		SenderUUID:     u.UUID,
+		Body:           sanitizeText(data.Body, 2000),
+	}
+
+	if m.Body == "" {
+		return ctx.JSON(http.StatusBadRequest, gettext("Message is required", ctx))
+	}
+
+	m.FlagReason = getMessageFlag(m.Body)
+	m.Flagged = m.FlagReason != ""
+
+	tx := db.Begin()
+
+	err = tx.Create(&m).Error
+	if err == nil {
+		err = tx.Model(&c).Updates(map[string]interface{}{"last_message_at": time.Now()}).Error
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to send message", ctx))
+	}
+
+	tx.Commit()
+
+	go func() {
+		e := map[string]interface{}{"conversation_uuid": c.UUID, "message": m}
+		publishEvent(to, EventMessage, e)
+		publishEvent(u.UUID, EventMessage, e)
+	}()
+
+	if !c.isMutedBy(to) {
+		n := Notification{SenderID: u.UUID, ReceiverID: to, ReferenceID: NewMessage}
+		go n.createAndSend()
+	}
+
+	return ctx.JSON(http.StatusCreated, m)
+}
+
+// readConversation marks every message the other member sent as read.
+func readConversation(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	c, err := getConversation(ctx.Param("uuid"), u.UUID)
+	if err != nil {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	now := time.Now()
+	db.Model(&Message{}).Where("conversation_id = ? AND sender_uuid != ? AND read_at IS NULL", c.ID, u.UUID).Updates(map[string]interface{}{"read_at": now})
+
+	go publishEvent(c.getOtherUUID(u.UUID), EventRead, map[string]interface{}{"conversation_uuid": c.UUID, "read_at": now})
+
+	return ctx.NoContent(http.StatusOK)
+}
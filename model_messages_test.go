@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestContainsWord(t *testing.T) {
+	tests := []struct {
+		s    string
+		w    string
+		want bool
+	}{
+		{"you idiot", "idiot", true},
+		{"idiot!", "idiot", true},
+		{"idiotic plan", "idiot", false},
+		{"first class seats", "ass", false},
+		{"please send money now", "send money", true},
+		{"send moneygram", "send money", false},
+		{"classy ass", "ass", true},
+		{"मूर्ख आदमी", "मूर्ख", true},
+		{"कमाल है", "कम", false},
+		{"", "idiot", false},
+	}
+
+	for _, tt := range tests {
+		if got := containsWord(tt.s, tt.w); got != tt.want {
+			t.Errorf("containsWord(%q, %q) = %v, want %v", tt.s, tt.w, got, tt.want)
+		}
+	}
+}
+
+func TestGetMessageFlagSkipsBlankKeywords(t *testing.T) {
+	old := os.Getenv("VM_MESSAGE_ABUSE_WORDS")
+	os.Setenv("VM_MESSAGE_ABUSE_WORDS", "idiot, ,stupid,")
+	defer os.Setenv("VM_MESSAGE_ABUSE_WORDS", old)
+
+	if f := getMessageFlag("See you at the temple tomorrow"); f != "" {
+		t.Errorf("got flag %q for an ordinary message, want none", f)
+	}
+
+	if f := getMessageFlag("Don't be Stupid"); f != MessageFlagAbuse {
+		t.Errorf("got flag %q, want %q", f, MessageFlagAbuse)
+	}
+}
@@ -24,6 +24,10 @@ type Notification struct {
 }
 
 func (n *Notification) createAndSend() {
+	if isBlocked(n.SenderID, n.ReceiverID) {
+		return
+	}
+
 	// generate the notification
 	n.generate()
 
@@ -35,7 +39,10 @@ func (n *Notification) createAndSend() {
 
 	if err != nil {
 		log.Println("Error while saving notification to DB: ", err.Error())
+		return
 	}
+
+	publishEvent(n.ReceiverID, EventNotification, n)
 }
 
 func (n *Notification) generate() {
@@ -52,11 +59,37 @@ func (n *Notification) generate() {
 	}
 
 	switch n.ReferenceID {
-	case 1:
-	case 2:
+	case PersonLoginReminder:
+	case PersonInterested:
 		n.Message = fmt.Sprintf("%s has shown interest in your profile.", n.Sender.getName())
-	case 3:
+	case PersonVisited:
 		n.Message = fmt.Sprintf("%s has visited your profile.", n.Sender.getName())
+	case PersonInterestAccepted:
+		n.Message = fmt.Sprintf("%s has accepted your interest.", n.Sender.getName())
+	case PersonInterestDeclined:
+		n.Message = fmt.Sprintf("%s has declined your interest.", n.Sender.getName())
+	case PersonInterestWithdrawn:
+		n.Message = fmt.Sprintf("%s has withdrawn their interest.", n.Sender.getName())
+	case PersonInterestExpired:
+		n.Message = fmt.Sprintf("Your interest in %s has expired.", n.Sender.getName())
+	case NewMessage:
+		n.Message = fmt.Sprintf("%s sent you a message.", n.Sender.getName())
+	case AccountWarned:
+		n.Message = "You have received a warning from our moderation team. Please review our community guidelines."
+	case ReportResolved:
+		n.Message = "Thank you for your report. Our moderation team has reviewed it."
+	case MembershipExpiring:
+		n.Message = "Your membership expires soon. Renew to keep your premium benefits."
+	case MembershipExpired:
+		n.Message = "Your membership has expired and your account is now on the free plan."
+	case ReferralRewardPosted:
+		n.Message = fmt.Sprintf("%s joined with your referral code. Reward credits have been added to your wallet.", n.Sender.getName())
+	case PhotoRejected:
+		n.Message = "One of your photos was not approved. Please check the reason and upload another photo."
+	case BadgeGranted:
+		n.Message = "Your verification has been approved and a badge has been added to your profile."
+	case VerificationDeclined:
+		n.Message = "Your verification could not be approved. Please check the reason and try again."
 	}
 
 	if token, exist := n.Receiver.OtherInfo["fcmToken"]; exist && len(token.(string)) > 0 {
@@ -1,13 +1,14 @@
 package main
 
 import (
-	"database/sql"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,84 +18,327 @@ import (
 
 type Payment struct {
 	gorm.Model
-	UserUUID string          `gorm:"type:uuid;index;" json:"user_uuid"`
-	Success  bool            `json:"success"`
-	Code     string          `json:"code"`
-	Message  string          `json:"message"`
-	Data     json.RawMessage `json:"data"` // Store PaymentData as JSON
+	UserUUID      string          `gorm:"type:uuid;index;" json:"user_uuid"`
+	TransactionID string          `gorm:"unique_index" json:"transaction_id"`
+	Amount        float64         `json:"amount"`
+	PlanID        uint            `gorm:"index" json:"-"` // set when the payment buys a plan
+	CouponID      uint            `gorm:"index" json:"-"`
+	Discount      float64         `json:"discount"`
+	Status        string          `gorm:"index" json:"status"`
+	Success       bool            `json:"success"`
+	Code          string          `json:"code"`
+	Message       string          `json:"message"`
+	Data          json.RawMessage `json:"data"` // Gateway status response
 }
 
-func savePayments(ctx echo.Context) error {
-	u, errr := verifySession(ctx)
-	if errr != nil {
-		return ctx.JSON(http.StatusUnauthorized, errr.Error())
+func getPaymentAmountLimits() (float64, float64) {
+	min, err := strconv.ParseFloat(os.Getenv("VM_PAYMENT_MIN_AMOUNT"), 64)
+	if err != nil || min <= 0 {
+		min = 1
+	}
+
+	max, err := strconv.ParseFloat(os.Getenv("VM_PAYMENT_MAX_AMOUNT"), 64)
+	if err != nil || max < min {
+		max = 100000
+	}
+
+	return min, max
+}
+
+// settle asks the gateway for the state of a pending payment and, when it
+// has completed, credits the wallet in the same transaction. Only one caller
+// can move a payment out of pending, so callbacks, client checks and the
+// cron job never credit twice.
+func (p *Payment) settle() error {
+	if p.Status != PaymentPending {
+		return nil
+	}
+
+	s, err := paymentGateway.checkStatus(p.TransactionID)
+	if err != nil {
+		return err
+	}
+
+	if s.Status == PaymentPending {
+		return nil
 	}
 
+	if s.Status == PaymentSuccess && roundAmount(s.Amount) != roundAmount(p.Amount) {
+		text := fmt.Sprintf("Transaction: %s <br> Expected: %.2f <br> Paid: %.2f", p.TransactionID, p.Amount, s.Amount)
+		go sendDebugEmail("Payment amount mismatch", text)
+
+		s.Status = PaymentFailed
+		s.Message = "Amount mismatch"
+	}
+
+	couponFailed := false
+
+	tx := db.Begin()
+
+	res := tx.Model(&Payment{}).Where("id = ? AND status = ?", p.ID, PaymentPending).Updates(map[string]interface{}{
+		"status":  s.Status,
+		"success": s.Status == PaymentSuccess,
+		"code":    s.Code,
+		"message": s.Message,
+		"data":    s.Data,
+	})
+	if res.Error != nil || res.RowsAffected == 0 {
+		tx.Rollback()
+		return res.Error
+	}
+
+	if s.Status == PaymentSuccess {
+		reference := "payment:" + strconv.Itoa(int(p.ID))
+
+		_, err = postLedgerEntry(tx, p.UserUUID, LedgerCredit, p.Amount, reference, "Wallet top-up")
+		if err != nil && err != errDuplicateLedgerEntry {
+			tx.Rollback()
+			return err
+		}
+
+		// A plan purchase goes through the wallet so the ledger shows both legs
+		if p.PlanID != 0 {
+			var plan Plan
+			db.Unscoped().Where("id = ?", p.PlanID).First(&plan)
+
+			err = nil
+
+			// The coupon is claimed first. If it ran out while the member was
+			// paying, the payment stays in the wallet as a top-up rather than
+			// buying the plan at a discount nobody can have any more.
+			if p.CouponID != 0 {
+				err = redeemCoupon(tx, p.CouponID, p.UserUUID, p.Discount, reference)
+			}
+
+			// The payment becomes a top-up, so it is invoiced and refunded as one
+			if err == errCouponUnavailable {
+				couponFailed = true
+				err = tx.Model(&Payment{}).Where("id = ?", p.ID).UpdateColumns(map[string]interface{}{
+					"message": "Coupon no longer available, amount added to wallet",
+					"plan_id": 0,
+				}).Error
+			} else if err == nil {
+				_, err = postLedgerEntry(tx, p.UserUUID, LedgerDebit, -p.Amount, "subscription:"+reference, plan.Name+" membership")
+				if err == nil {
+					_, err = activateSubscription(tx, p.UserUUID, plan, "subscription:"+reference)
+				}
+			}
+
+			if err != nil && err != errDuplicateLedgerEntry {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	if s.Status == PaymentSuccess && p.Amount >= getReferralMinPurchase() && isFirstPayment(*p) {
+		go rewardReferral(p.UserUUID)
+	}
+
+	p.Status = s.Status
+	p.Success = s.Status == PaymentSuccess
+	p.Code = s.Code
+	p.Message = s.Message
+
+	if couponFailed {
+		p.PlanID = 0
+		p.Message = "Coupon no longer available, amount added to wallet"
+		log.Println("Coupon could not be redeemed for payment: ", p.TransactionID)
+	}
+
+	if p.Success {
+		go issueAndSendInvoice(*p)
+	}
+
+	return nil
+}
+
+// createPaymentOrder registers a pending payment and returns the gateway page
+// the app should open. With a plan code the amount is the plan price, less
+// any coupon, and the plan is activated once the payment completes.
+func createPaymentOrder(ctx echo.Context) error {
 	var (
-		p              Payment
-		paymentData    map[string]json.RawMessage
-		responseBytes  []byte
-		responseString string
-		decodedBody    []byte
-		err            error
+		plan   Plan
+		coupon Coupon
+		data   struct {
+			Amount     float64 `json:"amount"`
+			PlanCode   string  `json:"plan_code"`
+			CouponCode string  `json:"coupon_code"`
+		}
 	)
 
-	// Read the request body as a byte array
-	body, err := io.ReadAll(ctx.Request().Body)
+	u, err := verifySession(ctx)
 	if err != nil {
-		log.Println("Error reading request body:", err.Error())
-		return returnInvalidData(ctx, err)
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
 	}
 
-	// Decode the JSON data directly
-	err = json.Unmarshal(body, &paymentData)
+	err = ctx.Bind(&data)
 	if err != nil {
-		log.Println("Error unmarshalling JSON data:", err.Error())
 		return returnInvalidData(ctx, err)
 	}
 
-	// Access the "response" data
-	responseBytes, ok := paymentData["response"]
-	if !ok {
-		log.Println("Error: Missing \"response\" key in request body")
-		return returnInvalidData(ctx, err)
+	if data.PlanCode != "" {
+		plan, err = getActivePlan(data.PlanCode)
+		if err != nil {
+			return ctx.JSON(http.StatusNotFound, gettext("Plan not found", ctx))
+		}
+
+		data.Amount = plan.Price
+
+		if data.CouponCode != "" {
+			coupon, err = checkCoupon(ctx, data.CouponCode, u.UUID, plan)
+			if err != nil {
+				return ctx.JSON(http.StatusBadRequest, err.Error())
+			}
+
+			data.Amount = roundAmount(plan.Price - coupon.discountFor(plan))
+		}
+
+		if data.Amount <= 0 {
+			return ctx.JSON(http.StatusBadRequest, gettext("Nothing to pay, buy this plan from your wallet", ctx))
+		}
 	}
 
-	responseString = strings.TrimSpace(string(responseBytes))
-	responseString = responseString[1 : len(responseString)-1]
+	min, max := getPaymentAmountLimits()
+	if plan.ID == 0 && (data.Amount < min || data.Amount > max) {
+		return ctx.JSON(http.StatusBadRequest, gettext("Invalid amount", ctx))
+	}
+
+	id, err := generateRandomString(24)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to create payment", ctx))
+	}
+
+	p := Payment{
+		UserUUID:      u.UUID,
+		TransactionID: "VM" + id,
+		Amount:        roundAmount(data.Amount),
+		PlanID:        plan.ID,
+		CouponID:      coupon.ID,
+		Discount:      coupon.discountFor(plan),
+		Status:        PaymentPending,
+	}
+
+	err = db.Create(&p).Error
+	if err != nil {
+		log.Println("Error while saving payment to DB:", err.Error())
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to create payment", ctx))
+	}
+
+	url, err := paymentGateway.createOrder(GatewayOrder{TransactionID: p.TransactionID, UserUUID: u.UUID, Amount: p.Amount})
+	if err != nil {
+		log.Println("Error while creating payment order:", err.Error())
+		db.Model(&p).Updates(map[string]interface{}{"status": PaymentFailed, "message": err.Error()})
 
-	// Attempt to decode the base64 data with error handling
-	decodedBody, err = base64.StdEncoding.DecodeString(responseString)
+		return ctx.JSON(http.StatusBadGateway, gettext("Unable to create payment", ctx))
+	}
+
+	return ctx.JSON(http.StatusCreated, map[string]interface{}{
+		"transaction_id": p.TransactionID,
+		"amount":         p.Amount,
+		"redirect_url":   url,
+	})
+}
+
+// savePayments is called by the app after the gateway redirects back. What the
+// app posts only identifies the transaction; its state comes from the gateway.
+func savePayments(ctx echo.Context) error {
+	var (
+		p    Payment
+		data struct {
+			TransactionID string `json:"transaction_id"`
+			Response      string `json:"response"`
+		}
+	)
+
+	u, err := verifySession(ctx)
 	if err != nil {
-		log.Println("Error decoding base64 data:", err.Error())
-		// Handle the error appropriately, e.g., return an error to the client
-		return echo.NewHTTPError(http.StatusBadRequest, "Invalid base64-encoded data")
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
 	}
 
-	// Unmarshal the decoded data into the Payment struct
-	err = json.Unmarshal(decodedBody, &p)
+	err = ctx.Bind(&data)
 	if err != nil {
-		log.Println("Error unmarshalling JSON data:", err.Error())
 		return returnInvalidData(ctx, err)
 	}
-	p.CreatedAt = time.Now()
-	p.UserUUID = u.UUID
 
-	// Use sql.NullInt64 to handle potential NULL values from the database
-	var nullID sql.NullInt64
-	err = db.Save(&p).Scan(&nullID).Error // Save data and scan for the ID
+	// Older apps post the gateway's base64 response instead of the ID
+	if data.TransactionID == "" && data.Response != "" {
+		var response struct {
+			Data struct {
+				MerchantTransactionID string `json:"merchantTransactionId"`
+			} `json:"data"`
+		}
+
+		b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(data.Response))
+		if err == nil && json.Unmarshal(b, &response) == nil {
+			data.TransactionID = response.Data.MerchantTransactionID
+		}
+	}
+
+	if data.TransactionID == "" || db.Where("transaction_id = ? AND user_uuid = ?", data.TransactionID, u.UUID).First(&p).RecordNotFound() {
+		return ctx.JSON(http.StatusNotFound, gettext("Payment not found", ctx))
+	}
+
+	err = p.settle()
+	if err != nil {
+		log.Println("Error while checking payment status:", err.Error())
+	}
+
+	return ctx.JSON(http.StatusOK, p)
+}
+
+// paymentCallbackHandler receives the gateway's server-to-server callback for
+// payments and refunds.
+func paymentCallbackHandler(ctx echo.Context) error {
+	var (
+		p Payment
+		r Refund
+	)
 
+	body, err := io.ReadAll(ctx.Request().Body)
 	if err != nil {
-		log.Println("Error while saving payment to DB:", err.Error())
-		return err
+		return ctx.NoContent(http.StatusBadRequest)
+	}
+
+	txID, err := paymentGateway.verifyCallback(body, ctx.Request().Header.Get("X-VERIFY"))
+	if err != nil {
+		log.Println("Rejected payment callback:", err.Error())
+		return ctx.NoContent(http.StatusUnauthorized)
 	}
 
-	// Check if the ID is valid (not NULL) before using it
-	if nullID.Valid {
-		fmt.Printf("Payment saved successfully with ID: %d\n", nullID.Int64)
+	if db.Where("transaction_id = ?", txID).First(&p).RecordNotFound() {
+		if db.Where("refund_id = ?", txID).First(&r).RecordNotFound() {
+			return ctx.NoContent(http.StatusNotFound)
+		}
+
+		err = r.settle()
 	} else {
-		fmt.Println("Payment saved, but ID is NULL")
+		err = p.settle()
 	}
 
-	return nil
+	if err != nil {
+		log.Println("Error while checking payment status:", err.Error())
+		return ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	return ctx.NoContent(http.StatusOK)
+}
+
+// settlePendingPayments checks payments whose callback never arrived.
+func settlePendingPayments() {
+	var pp []Payment
+
+	db.Where("status = ? AND created_at BETWEEN ? AND ?", PaymentPending, time.Now().AddDate(0, 0, -3), time.Now().Add(-10*time.Minute)).Find(&pp)
+
+	for _, p := range pp {
+		err := p.settle()
+		if err != nil {
+			log.Println("Error while checking payment status: ", err.Error())
+		}
+	}
 }
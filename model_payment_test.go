@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const testPaymentFakeSecret = "test-secret"
+
+// useFakeGateway swaps in a fake gateway for the test.
+func useFakeGateway(t *testing.T) *fakeGateway {
+	t.Helper()
+
+	gw := &fakeGateway{orders: make(map[string]GatewayOrder)}
+
+	old := paymentGateway
+	paymentGateway = gw
+	os.Setenv("VM_PAYMENT_FAKE_SECRET", testPaymentFakeSecret)
+
+	t.Cleanup(func() {
+		paymentGateway = old
+	})
+
+	return gw
+}
+
+// createTestPayment registers a pending payment of amount, and an order of
+// gatewayAmount with the fake gateway.
+func createTestPayment(t *testing.T, gw *fakeGateway, amount float64, gatewayAmount float64) Payment {
+	t.Helper()
+
+	userUUID := newTestUserUUID()
+
+	p := Payment{
+		UserUUID:      userUUID,
+		TransactionID: "TEST" + strings.Replace(userUUID, "-", "", -1),
+		Amount:        amount,
+		Status:        PaymentPending,
+	}
+
+	err := db.Create(&p).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = gw.createOrder(GatewayOrder{TransactionID: p.TransactionID, UserUUID: userUUID, Amount: gatewayAmount})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+func getTestPayment(t *testing.T, id uint) Payment {
+	t.Helper()
+
+	var p Payment
+
+	err := db.Where("id = ?", id).First(&p).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// postTestCallback sends a callback signed the way the fake gateway expects.
+// It is called from several goroutines, so it must not stop the test.
+func postTestCallback(t *testing.T, transactionID string) int {
+	t.Helper()
+
+	body := `{"transaction_id":"` + transactionID + `"}`
+
+	mac := hmac.New(sha256.New, []byte(testPaymentFakeSecret))
+	mac.Write([]byte(body))
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payments/callback", strings.NewReader(body))
+	req.Header.Set("X-VERIFY", hex.EncodeToString(mac.Sum(nil)))
+	rec := httptest.NewRecorder()
+
+	err := paymentCallbackHandler(echo.New().NewContext(req, rec))
+	if err != nil {
+		t.Error(err)
+	}
+
+	return rec.Code
+}
+
+func TestSettleCreditsWallet(t *testing.T) {
+	setupTestDB(t)
+	gw := useFakeGateway(t)
+
+	p := createTestPayment(t, gw, 100, 100)
+
+	if code := postTestCallback(t, p.TransactionID); code != http.StatusOK {
+		t.Fatalf("got status %d, want %d", code, http.StatusOK)
+	}
+
+	if p = getTestPayment(t, p.ID); p.Status != PaymentSuccess || !p.Success {
+		t.Errorf("got status %s, want %s", p.Status, PaymentSuccess)
+	}
+
+	if b := getTestBalance(t, p.UserUUID); b != 100 {
+		t.Errorf("got balance %.2f, want 100", b)
+	}
+}
+
+func TestSettleIgnoresDoubleCallbacks(t *testing.T) {
+	setupTestDB(t)
+	gw := useFakeGateway(t)
+
+	p := createTestPayment(t, gw, 100, 100)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			postTestCallback(t, p.TransactionID)
+		}()
+	}
+
+	wg.Wait()
+
+	// A late duplicate after the payment has settled
+	if code := postTestCallback(t, p.TransactionID); code != http.StatusOK {
+		t.Errorf("got status %d for a duplicate callback, want %d", code, http.StatusOK)
+	}
+
+	if b := getTestBalance(t, p.UserUUID); b != 100 {
+		t.Errorf("got balance %.2f, want 100", b)
+	}
+}
+
+func TestSettleRejectsAmountMismatch(t *testing.T) {
+	setupTestDB(t)
+	gw := useFakeGateway(t)
+
+	p := createTestPayment(t, gw, 100, 1)
+
+	err := p.settle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if p = getTestPayment(t, p.ID); p.Status != PaymentFailed || p.Success {
+		t.Errorf("got status %s, want %s", p.Status, PaymentFailed)
+	}
+
+	if b := getTestBalance(t, p.UserUUID); b != 0 {
+		t.Errorf("got balance %.2f, want 0", b)
+	}
+}
+
+func TestSettleRejectsUnsignedCallbacks(t *testing.T) {
+	setupTestDB(t)
+	gw := useFakeGateway(t)
+
+	p := createTestPayment(t, gw, 100, 100)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/payments/callback", strings.NewReader(`{"transaction_id":"`+p.TransactionID+`"}`))
+	req.Header.Set("X-VERIFY", "forged")
+	rec := httptest.NewRecorder()
+
+	err := paymentCallbackHandler(echo.New().NewContext(req, rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	if p = getTestPayment(t, p.ID); p.Status != PaymentPending {
+		t.Errorf("got status %s, want %s", p.Status, PaymentPending)
+	}
+}
+
+func TestSettlePendingPaymentsReconciles(t *testing.T) {
+	setupTestDB(t)
+	gw := useFakeGateway(t)
+
+	// The callback never arrived
+	p := createTestPayment(t, gw, 250, 250)
+	db.Model(&Payment{}).Where("id = ?", p.ID).UpdateColumn("created_at", time.Now().Add(-time.Hour))
+
+	settlePendingPayments()
+
+	if p = getTestPayment(t, p.ID); p.Status != PaymentSuccess {
+		t.Errorf("got status %s, want %s", p.Status, PaymentSuccess)
+	}
+
+	if b := getTestBalance(t, p.UserUUID); b != 250 {
+		t.Errorf("got balance %.2f, want 250", b)
+	}
+
+	for _, m := range getWalletMismatches() {
+		if m.UserUUID == p.UserUUID {
+			t.Errorf("wallet has balance %.2f but ledger total %.2f", m.Balance, m.Total)
+		}
+	}
+}
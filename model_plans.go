@@ -0,0 +1,149 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	PlanFeatureChat     = "chat"
+	PlanFeatureVisitors = "visitors"
+)
+
+var planCodeRegexp = regexp.MustCompile(`^[a-z0-9-]{2,32}$`)
+
+// Plan is a paid membership. Members without an active subscription are on
+// the implicit "free" plan.
+type Plan struct {
+	Model
+
+	Code            string  `gorm:"unique_index" json:"code"`
+	Name            string  `json:"name"`
+	Description     string  `json:"description"`
+	Price           float64 `json:"price"`
+	DurationDays    int     `json:"duration_days"`
+	ContactUnlocks  int     `json:"contact_unlocks"`  // included with each subscription
+	VisibilityBoost int     `json:"visibility_boost"` // higher ranks first in search
+	SeeVisitors     bool    `json:"see_visitors"`
+	ChatAccess      bool    `json:"chat_access"`
+	Active          bool    `json:"active"`
+}
+
+func (p *Plan) sanitize() {
+	p.Name = sanitizeText(p.Name, 64)
+	p.Description = sanitizeText(p.Description, 1000)
+	p.Price = roundAmount(p.Price)
+}
+
+func (p *Plan) validate(ctx echo.Context) error {
+	if !planCodeRegexp.MatchString(p.Code) || p.Code == "free" {
+		return errors.New(gettext("Plan code is invalid", ctx))
+	}
+
+	if p.Name == "" {
+		return errors.New(gettext("Plan name is required", ctx))
+	}
+
+	if p.Price <= 0 || p.DurationDays <= 0 || p.ContactUnlocks < 0 || p.VisibilityBoost < 0 {
+		return errors.New(gettext("Plan price, duration, unlocks and boost must be positive", ctx))
+	}
+
+	return nil
+}
+
+func (p *Plan) allows(feature string) bool {
+	switch feature {
+	case PlanFeatureChat:
+		return p.ChatAccess
+	case PlanFeatureVisitors:
+		return p.SeeVisitors
+	}
+
+	return false
+}
+
+func getActivePlan(code string) (Plan, error) {
+	var p Plan
+
+	if code == "" || db.Where("code = ? AND active = ?", code, true).First(&p).RecordNotFound() {
+		return p, errors.New("Plan not found")
+	}
+
+	return p, nil
+}
+
+func plans(ctx echo.Context) error {
+	var pp []Plan
+
+	db.Where("active = ?", true).Order("price ASC").Find(&pp)
+
+	return ctx.JSON(http.StatusOK, pp)
+}
+
+func adminPlansHandler(ctx echo.Context) error {
+	var pp []Plan
+
+	db.Order("active DESC, price ASC").Find(&pp)
+
+	return ctx.JSON(http.StatusOK, pp)
+}
+
+func adminCreatePlanHandler(ctx echo.Context) error {
+	var p Plan
+
+	err := ctx.Bind(&p)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	p.zeroID()
+	p.sanitize()
+
+	err = p.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	err = db.Create(&p).Error
+	if err != nil {
+		return ctx.JSON(http.StatusConflict, gettext("A plan with this code already exists", ctx))
+	}
+
+	return ctx.JSON(http.StatusCreated, p)
+}
+
+// adminUpdatePlanHandler changes a plan for future purchases. Existing
+// subscriptions keep pointing at the plan, so a plan is retired by
+// deactivating it rather than deleting it.
+func adminUpdatePlanHandler(ctx echo.Context) error {
+	var p Plan
+
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&p).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	id, uuid, code := p.ID, p.UUID, p.Code
+
+	err := ctx.Bind(&p)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	p.ID, p.UUID, p.Code = id, uuid, code
+	p.sanitize()
+
+	err = p.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	err = db.Save(&p).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to save plan", ctx))
+	}
+
+	return ctx.JSON(http.StatusOK, p)
+}
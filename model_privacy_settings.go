@@ -0,0 +1,128 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	PrivacyPublic         = "public"
+	PrivacyMembers        = "members"
+	PrivacyMutualInterest = "mutual_interest"
+	PrivacyContactReveal  = "contact_reveal"
+	PrivacyHidden         = "hidden"
+)
+
+// PrivacySettings holds the visibility level a member picked for each of the
+// profile fields that other members may not always see.
+type PrivacySettings struct {
+	Phone       string `json:"phone"`
+	Email       string `json:"email"`
+	Address     string `json:"address"`
+	DateOfBirth string `json:"date_of_birth"`
+	Income      string `json:"annual_income"`
+	Photos      string `json:"photos"`
+
+	BrowseAnonymously bool `json:"browse_anonymously"`
+}
+
+func getPrivacyLevels() ListItems {
+	return createList(
+		[]string{"Everyone", PrivacyPublic},
+		[]string{"Members only", PrivacyMembers},
+		[]string{"After mutual interest", PrivacyMutualInterest},
+		[]string{"After contact reveal", PrivacyContactReveal},
+		[]string{"Hidden", PrivacyHidden},
+	)
+}
+
+func getPrivacyLevelsStrings() []string {
+	var ss []string
+
+	for _, l := range getPrivacyLevels() {
+		ss = append(ss, l.Value)
+	}
+
+	return ss
+}
+
+func (ps *PrivacySettings) applyDefaults() {
+	if ps.Phone == "" {
+		ps.Phone = PrivacyMutualInterest
+	}
+
+	if ps.Email == "" {
+		ps.Email = PrivacyMutualInterest
+	}
+
+	if ps.Address == "" {
+		ps.Address = PrivacyHidden
+	}
+
+	if ps.DateOfBirth == "" {
+		ps.DateOfBirth = PrivacyMembers
+	}
+
+	if ps.Income == "" {
+		ps.Income = PrivacyMembers
+	}
+
+	if ps.Photos == "" {
+		ps.Photos = PrivacyMembers
+	}
+}
+
+func (ps *PrivacySettings) validate(ctx echo.Context) error {
+	levels := getPrivacyLevelsStrings()
+
+	for _, l := range []string{ps.Phone, ps.Email, ps.Address, ps.DateOfBirth, ps.Income, ps.Photos} {
+		if l != "" && !isOneOf(l, levels) {
+			return errors.New(gettext("Privacy setting is invalid", ctx))
+		}
+	}
+
+	return nil
+}
+
+func (ps *PrivacySettings) Scan(value interface{}) error {
+	asBytes, ok := value.([]byte)
+	if !ok {
+		return nil
+	}
+
+	err := json.Unmarshal(asBytes, &ps)
+
+	return err
+}
+
+func (ps PrivacySettings) Value() (driver.Value, error) {
+	return json.Marshal(ps)
+}
+
+// profileAccess describes what one member has earned towards another member's
+// profile; it is compared against the owner's PrivacySettings. The levels are
+// ordered, so earning one also grants every level below it: a paid contact
+// reveal shows what mutual interest would.
+type profileAccess struct {
+	Member          bool
+	MutualInterest  bool
+	ContactRevealed bool
+}
+
+func (a profileAccess) allows(level string) bool {
+	switch level {
+	case PrivacyPublic:
+		return true
+	case PrivacyMembers:
+		return a.Member || a.MutualInterest || a.ContactRevealed
+	case PrivacyMutualInterest:
+		return a.MutualInterest || a.ContactRevealed
+	case PrivacyContactReveal:
+		return a.ContactRevealed
+	}
+
+	return false
+}
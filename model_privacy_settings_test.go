@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestProfileAccessAllows(t *testing.T) {
+	levels := []string{PrivacyPublic, PrivacyMembers, PrivacyMutualInterest, PrivacyContactReveal, PrivacyHidden}
+
+	tests := []struct {
+		name   string
+		access profileAccess
+		want   []bool
+	}{
+		{"stranger", profileAccess{}, []bool{true, false, false, false, false}},
+		{"member", profileAccess{Member: true}, []bool{true, true, false, false, false}},
+		{"mutual interest", profileAccess{Member: true, MutualInterest: true}, []bool{true, true, true, false, false}},
+		{"contact revealed", profileAccess{ContactRevealed: true}, []bool{true, true, true, true, false}},
+	}
+
+	for _, tt := range tests {
+		for i, l := range levels {
+			if got := tt.access.allows(l); got != tt.want[i] {
+				t.Errorf("%s: allows(%s) = %v, want %v", tt.name, l, got, tt.want[i])
+			}
+		}
+	}
+}
+
+// An unlock is paid for, so with the default settings it must show both the
+// phone number and the email address.
+func TestContactRevealShowsDefaultContactFields(t *testing.T) {
+	var ps PrivacySettings
+
+	ps.applyDefaults()
+
+	a := profileAccess{Member: true, ContactRevealed: true}
+
+	if !a.allows(ps.Phone) {
+		t.Errorf("unlock does not show the phone at the default level %s", ps.Phone)
+	}
+
+	if !a.allows(ps.Email) {
+		t.Errorf("unlock does not show the email at the default level %s", ps.Email)
+	}
+
+	if a.allows(ps.Address) {
+		t.Errorf("unlock shows the address at the default level %s", ps.Address)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+// ProfileCard is the compact projection of a User returned to other members
+// in search results and interest listings. Fields covered by PrivacySettings
+// are only filled in when the viewer's profileAccess allows them.
+type ProfileCard struct {
+	UUID             string          `json:"uuid"`
+	FirstName        string          `json:"first_name"`
+	LastName         string          `json:"last_name"`
+	Gender           string          `json:"gender"`
+	MaritalStatus    string          `json:"marital_status"`
+	DOB              string          `json:"date_of_birth"`
+	Caste            string          `json:"caste"`
+	SubCaste         string          `json:"sub_caste"`
+	AnnualIncome     uint            `json:"annual_income"`
+	ProfileCreatedBy string          `json:"profile_created_by"`
+	JobTitle         string          `json:"job_title"`
+	City             string          `json:"city"`
+	District         string          `json:"district"`
+	State            string          `json:"State"`
+	Country          string          `json:"country"`
+	EducationalInfo  EducationalInfo `json:"educational_info"`
+	CareerInfo       CareerInfo      `json:"career_info"`
+	FamilyInfo       FamilyInfo      `json:"family_info"`
+	IsVerified       bool            `json:"is_verified"`
+	Attributes
+	Badges []string `json:"badges"`
+
+	// Deprecated: the misspelt key older clients read. Use EducationalInfo.
+	LegacyEducationalInfo EducationalInfo `json:"educationl_info"`
+
+	Phone      string `json:"phone,omitempty"`
+	Email      Email  `json:"email,omitempty"`
+	Address1   string `json:"address_1,omitempty"`
+	Address2   string `json:"address_2,omitempty"`
+	PostalCode string `json:"postal_code,omitempty"`
+
+	UserMedia       []Media       `json:"user_media"`
+	PhotosHidden    bool          `json:"photos_hidden"`
+	InterestDetails *UserInterest `json:"interest_details"`
+	Shortlisted     bool          `json:"shortlisted"`
+}
+
+func newProfileCard(u User) ProfileCard {
+	return ProfileCard{
+		UUID:                  u.UUID,
+		FirstName:             u.FirstName,
+		LastName:              u.LastName,
+		Gender:                u.Gender,
+		MaritalStatus:         u.MaritalStatus,
+		Caste:                 u.Caste,
+		SubCaste:              u.SubCaste,
+		ProfileCreatedBy:      u.ProfileCreatedBy,
+		JobTitle:              u.JobTitle,
+		City:                  u.City,
+		District:              u.District,
+		State:                 u.State,
+		Country:               u.Country,
+		EducationalInfo:       u.EducationalInfo,
+		LegacyEducationalInfo: u.EducationalInfo,
+		CareerInfo:            u.CareerInfo,
+		FamilyInfo:            u.FamilyInfo,
+		IsVerified:            u.IsVerified,
+		Attributes:            u.Attributes,
+		Badges:                []string{},
+		UserMedia:             []Media{},
+		InterestDetails:       &UserInterest{},
+	}
+}
+
+func (c *ProfileCard) applyPrivacy(u User, a profileAccess) {
+	ps := u.PrivacySettings
+	ps.applyDefaults()
+
+	if a.allows(ps.Phone) {
+		c.Phone = u.Phone
+	}
+
+	if a.allows(ps.Email) {
+		c.Email = u.Email
+	}
+
+	if a.allows(ps.Address) {
+		c.Address1 = u.Address1
+		c.Address2 = u.Address2
+		c.PostalCode = u.PostalCode
+	}
+
+	if a.allows(ps.DateOfBirth) {
+		c.DOB = u.DOB
+	}
+
+	if a.allows(ps.Income) {
+		c.AnnualIncome = u.AnnualIncome
+	}
+
+	c.PhotosHidden = !a.allows(ps.Photos)
+}
+
+// loadProfileCards projects a page of users into cards as seen by the viewer.
+// Media, interest state in both directions, the viewer's shortlist and contact
+// unlocks are each fetched with one query, and the owner's privacy settings
+// are applied.
+func loadProfileCards(viewerUUID string, uu []User) []ProfileCard {
+	cc := make([]ProfileCard, 0, len(uu))
+
+	if len(uu) == 0 {
+		return cc
+	}
+
+	uuids := make([]string, 0, len(uu))
+	index := make(map[string]int, len(uu))
+
+	for _, u := range uu {
+		index[u.UUID] = len(cc)
+		uuids = append(uuids, u.UUID)
+		cc = append(cc, newProfileCard(u))
+	}
+
+	var sent, received []UserInterest
+	db.Where("from_user_uuid = ? AND to_user_uuid IN (?)", viewerUUID, uuids).Find(&sent)
+	db.Where("from_user_uuid IN (?) AND to_user_uuid = ?", uuids, viewerUUID).Find(&received)
+
+	access := make([]profileAccess, len(cc))
+	for i := range access {
+		access[i].Member = viewerUUID != ""
+	}
+
+	for _, ui := range sent {
+		if i, ok := index[ui.ToUserUUID]; ok {
+			ui := ui
+			cc[i].InterestDetails = &ui
+		}
+	}
+
+	for _, ui := range received {
+		if i, ok := index[ui.FromUserUUID]; ok && isMatch(ui) {
+			access[i].MutualInterest = true
+		}
+	}
+
+	var ss []Shortlist
+	db.Where("user_uuid = ? AND profile_uuid IN (?)", viewerUUID, uuids).Find(&ss)
+
+	for _, s := range ss {
+		if i, ok := index[s.ProfileUUID]; ok {
+			cc[i].Shortlisted = true
+		}
+	}
+
+	var unlocks []ContactUnlock
+	db.Where("viewer_uuid = ? AND profile_uuid IN (?)", viewerUUID, uuids).Find(&unlocks)
+
+	for _, cu := range unlocks {
+		if i, ok := index[cu.ProfileUUID]; ok {
+			access[i].ContactRevealed = true
+		}
+	}
+
+	for i, u := range uu {
+		if isMatch(*cc[i].InterestDetails) {
+			access[i].MutualInterest = true
+		}
+
+		cc[i].applyPrivacy(u, access[i])
+	}
+
+	for u, bb := range getBadges(uuids) {
+		if i, ok := index[u]; ok {
+			cc[i].Badges = bb
+		}
+	}
+
+	var mm []Media
+	db.Where("user_uuid IN (?) AND ((status = ? AND type <> ?) OR user_uuid = ?)", uuids, MediaApproved, MediaIDDocument, viewerUUID).Order("is_primary DESC, position ASC, id ASC").Find(&mm)
+
+	for _, m := range mm {
+		if i, ok := index[m.UserUUID]; ok && !cc[i].PhotosHidden {
+			cc[i].UserMedia = append(cc[i].UserMedia, m)
+		}
+	}
+
+	return cc
+}
+
+// getProfileCard returns a single user's card as seen by the viewer.
+func getProfileCard(viewerUUID string, u User) ProfileCard {
+	return loadProfileCards(viewerUUID, []User{u})[0]
+}
+
+// getProfileCards fetches the users with the given UUIDs and returns their
+// cards keyed by UUID.
+func getProfileCards(viewerUUID string, uuids []string) map[string]ProfileCard {
+	m := make(map[string]ProfileCard, len(uuids))
+
+	uuids = getUnique(uuids)
+	if len(uuids) == 0 {
+		return m
+	}
+
+	var uu []User
+	db.Where("uuid IN (?)", uuids).Find(&uu)
+
+	for _, c := range loadProfileCards(viewerUUID, uu) {
+		m[c.UUID] = c
+	}
+
+	return m
+}
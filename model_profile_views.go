@@ -0,0 +1,146 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+// ProfileView is recorded at most once per viewer, profile and day.
+type ProfileView struct {
+	ID         uint      `gorm:"primary_key" json:"-"`
+	ViewerUUID string    `gorm:"type:uuid;unique_index:idx_profile_views_daily" json:"viewer_uuid,omitempty"`
+	ViewedUUID string    `gorm:"type:uuid;index;unique_index:idx_profile_views_daily" json:"-"`
+	ViewedOn   time.Time `gorm:"type:date;unique_index:idx_profile_views_daily" json:"viewed_on"`
+	Anonymous  bool      `json:"anonymous"`
+
+	Viewer *ProfileCard `gorm:"-" json:"viewer,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func recordProfileView(viewer User, viewedUUID string) {
+	if viewer.UUID == "" || viewer.UUID == viewedUUID {
+		return
+	}
+
+	err := db.Exec(`INSERT INTO profile_views (viewer_uuid, viewed_uuid, viewed_on, anonymous, created_at)
+		VALUES (?, ?, CURRENT_DATE, ?, NOW())
+		ON CONFLICT (viewer_uuid, viewed_uuid, viewed_on) DO NOTHING`,
+		viewer.UUID, viewedUUID, viewer.PrivacySettings.BrowseAnonymously).Error
+
+	if err != nil {
+		log.Println("Error while recording profile view: ", err.Error())
+	}
+}
+
+func canSeeVisitorIdentities(u User) bool {
+	return hasPlanFeature(u.UUID, PlanFeatureVisitors)
+}
+
+func userProfileHandler(ctx echo.Context) error {
+	viewer, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var u User
+
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&u).RecordNotFound() || isBlocked(viewer.UUID, u.UUID) {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if u.checkStanding(ctx) != nil {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	go recordProfileView(viewer, u.UUID)
+
+	return ctx.JSON(http.StatusOK, u.project(viewer))
+}
+
+func visitors(ctx echo.Context) error {
+	var (
+		resp struct {
+			Count    uint          `json:"count"`
+			Visitors []ProfileView `json:"visitors"`
+		}
+		vv []ProfileView
+	)
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	page, err := strconv.Atoi(ctx.QueryParam("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit := 20
+
+	dbQuery := excludeBlocked(db.Model(&ProfileView{}), u.UUID, "viewer_uuid").Where("viewed_uuid = ?", u.UUID)
+	dbQuery.Count(&resp.Count)
+
+	dbQuery.Order("created_at DESC").Limit(limit).Offset(limit * (page - 1)).Find(&vv)
+
+	showIdentities := canSeeVisitorIdentities(u)
+
+	uuids := make([]string, 0, len(vv))
+	for _, v := range vv {
+		if showIdentities && !v.Anonymous {
+			uuids = append(uuids, v.ViewerUUID)
+		}
+	}
+
+	cards := getProfileCards(u.UUID, uuids)
+	for i, v := range vv {
+		if c, ok := cards[v.ViewerUUID]; ok && showIdentities && !v.Anonymous {
+			vv[i].Viewer = &c
+			continue
+		}
+
+		vv[i].ViewerUUID = ""
+	}
+
+	resp.Visitors = vv
+
+	return ctx.JSON(http.StatusOK, resp)
+}
+
+// migrateVisitedInterests moves visits that the client used to post as
+// "visited" interests into profile views. The original rows are kept in
+// user_interests_visited.
+func migrateVisitedInterests() {
+	err := db.Exec("CREATE TABLE IF NOT EXISTS user_interests_visited (LIKE user_interests INCLUDING DEFAULTS)").Error
+	if err != nil {
+		log.Println("Error while migrating visits: ", err.Error())
+		return
+	}
+
+	tx := db.Begin()
+
+	err = tx.Exec(`INSERT INTO profile_views (viewer_uuid, viewed_uuid, viewed_on, anonymous, created_at)
+		SELECT from_user_uuid::uuid, to_user_uuid::uuid, updated_at::date, false, updated_at
+		FROM user_interests
+		WHERE LOWER(type) = 'visited' AND COALESCE(status, '') = ''
+		ON CONFLICT (viewer_uuid, viewed_uuid, viewed_on) DO NOTHING`).Error
+
+	if err == nil {
+		err = tx.Exec(`WITH moved AS (
+			DELETE FROM user_interests WHERE LOWER(type) = 'visited' AND COALESCE(status, '') = '' RETURNING *
+		) INSERT INTO user_interests_visited SELECT * FROM moved`).Error
+	}
+
+	if err != nil {
+		tx.Rollback()
+		log.Println("Error while migrating visits: ", err.Error())
+		return
+	}
+
+	tx.Commit()
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	ReferralPending  = "pending"
+	ReferralRewarded = "rewarded"
+)
+
+// ReferralCode is the code a member shares with friends.
+type ReferralCode struct {
+	ID        uint      `gorm:"primary_key" json:"-"`
+	UserUUID  string    `gorm:"type:uuid;unique_index" json:"-"`
+	Code      string    `gorm:"unique_index" json:"code"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Referral links a new member to the member who referred them. The referrer
+// is rewarded once, when the new member is verified or first pays.
+type Referral struct {
+	Model
+
+	ReferrerUUID string       `gorm:"type:uuid;index" json:"-"`
+	RefereeUUID  string       `gorm:"type:uuid;unique_index" json:"-"`
+	Code         string       `json:"code"`
+	Status       string       `gorm:"index" json:"status"`
+	RewardedAt   sql.NullTime `json:"rewarded_at"`
+
+	Referee *ProfileCard `gorm:"-" json:"referee,omitempty"`
+}
+
+func getReferralRewards() (float64, float64) {
+	referrer, err := strconv.ParseFloat(os.Getenv("VM_REFERRAL_REWARD"), 64)
+	if err != nil || referrer < 0 {
+		referrer = 100
+	}
+
+	referee, err := strconv.ParseFloat(os.Getenv("VM_REFERRAL_REFEREE_REWARD"), 64)
+	if err != nil || referee < 0 {
+		referee = 0
+	}
+
+	return referrer, referee
+}
+
+// getReferralMinPurchase is the smallest first payment that earns a referral
+// reward. It is kept well above the gateway minimum so that a throwaway
+// account cannot farm rewards with token payments.
+func getReferralMinPurchase() float64 {
+	min, err := strconv.ParseFloat(os.Getenv("VM_REFERRAL_MIN_PURCHASE"), 64)
+	if err != nil || min <= 0 {
+		min = 499
+	}
+
+	return min
+}
+
+// getReferralCode returns the member's code, creating it on first use.
+func getReferralCode(userUUID string) (ReferralCode, error) {
+	var rc ReferralCode
+
+	if !db.Where("user_uuid = ?", userUUID).First(&rc).RecordNotFound() {
+		return rc, nil
+	}
+
+	for i := 0; i < 5; i++ {
+		code, err := generateRandomString(8)
+		if err != nil {
+			return rc, err
+		}
+
+		rc = ReferralCode{UserUUID: userUUID, Code: strings.ToUpper(code)}
+
+		if db.Create(&rc).Error == nil {
+			return rc, nil
+		}
+
+		// Either the code is taken or a concurrent request created one
+		if !db.Where("user_uuid = ?", userUUID).First(&rc).RecordNotFound() {
+			return rc, nil
+		}
+	}
+
+	return rc, errors.New("Unable to create referral code")
+}
+
+// attributeReferral records who referred a member who just registered.
+func attributeReferral(refereeUUID string, code string) {
+	var rc ReferralCode
+
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if code == "" || db.Where("code = ?", code).First(&rc).RecordNotFound() || rc.UserUUID == refereeUUID {
+		return
+	}
+
+	r := Referral{ReferrerUUID: rc.UserUUID, RefereeUUID: refereeUUID, Code: code, Status: ReferralPending}
+
+	err := db.Create(&r).Error
+	if err != nil {
+		log.Println("Error while saving referral: ", err.Error())
+	}
+}
+
+// rewardReferral credits the referrer (and the referee, if configured) the
+// first time it is called for a referee. It is called on qualifying events
+// only: a first successful payment of at least getReferralMinPurchase,
+// whether a top-up or a plan, or an approved ID verification.
+func rewardReferral(refereeUUID string) {
+	var r Referral
+
+	if db.Where("referee_uuid = ? AND status = ?", refereeUUID, ReferralPending).First(&r).RecordNotFound() {
+		return
+	}
+
+	referrerReward, refereeReward := getReferralRewards()
+
+	tx := db.Begin()
+
+	res := tx.Model(&Referral{}).Where("id = ? AND status = ?", r.ID, ReferralPending).Updates(map[string]interface{}{"status": ReferralRewarded, "rewarded_at": time.Now()})
+	if res.Error != nil || res.RowsAffected == 0 {
+		tx.Rollback()
+		return
+	}
+
+	var err error
+
+	if referrerReward > 0 {
+		_, err = postLedgerEntry(tx, r.ReferrerUUID, LedgerBonus, referrerReward, "referral:"+r.UUID, "Referral reward")
+	}
+
+	if err == nil && refereeReward > 0 {
+		_, err = postLedgerEntry(tx, r.RefereeUUID, LedgerBonus, refereeReward, "referral-welcome:"+r.UUID, "Welcome reward")
+	}
+
+	if err != nil {
+		tx.Rollback()
+		log.Println("Error while rewarding referral: ", err.Error())
+		return
+	}
+
+	tx.Commit()
+
+	n := Notification{SenderID: r.RefereeUUID, ReceiverID: r.ReferrerUUID, ReferenceID: ReferralRewardPosted}
+	n.createAndSend()
+}
+
+// isFirstPayment reports whether p is the member's only successful payment.
+func isFirstPayment(p Payment) bool {
+	var count int
+
+	db.Model(&Payment{}).Where("user_uuid = ? AND status = ? AND id != ?", p.UserUUID, PaymentSuccess, p.ID).Count(&count)
+
+	return count == 0
+}
+
+func referrals(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	rc, err := getReferralCode(u.UUID)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to create referral code", ctx))
+	}
+
+	var rr []Referral
+
+	db.Where("referrer_uuid = ?", u.UUID).Order("created_at DESC").Find(&rr)
+
+	uuids := make([]string, 0, len(rr))
+	for _, r := range rr {
+		uuids = append(uuids, r.RefereeUUID)
+	}
+
+	cards := getProfileCards(u.UUID, uuids)
+	for i, r := range rr {
+		if c, ok := cards[r.RefereeUUID]; ok {
+			rr[i].Referee = &c
+		}
+	}
+
+	reward, _ := getReferralRewards()
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"code":      rc.Code,
+		"reward":    reward,
+		"referrals": rr,
+	})
+}
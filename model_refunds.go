@@ -0,0 +1,199 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+var errRefundExceedsPayment = errors.New("Refund exceeds the refundable amount")
+
+// Refund returns part or all of a payment through the gateway. The credits
+// leave the wallet when the refund is requested and are put back if the
+// gateway rejects it.
+type Refund struct {
+	Model
+
+	PaymentID   uint    `gorm:"index" json:"-"`
+	UserUUID    string  `gorm:"type:uuid;index" json:"user_uuid"`
+	RefundID    string  `gorm:"unique_index" json:"refund_id"`
+	Amount      float64 `json:"amount"`
+	Status      string  `gorm:"index" json:"status"`
+	Reason      string  `json:"reason"`
+	RequestedBy string  `json:"requested_by"`
+	Code        string  `json:"code"`
+	Message     string  `json:"message"`
+}
+
+func getRefundedAmount(tx *gorm.DB, paymentID uint) float64 {
+	var r struct {
+		Total float64
+	}
+
+	tx.Model(&Refund{}).Select("COALESCE(SUM(amount), 0) AS total").Where("payment_id = ? AND status != ?", paymentID, PaymentFailed).Scan(&r)
+
+	return r.Total
+}
+
+// issueRefund reverses the ledger and asks the gateway to refund amount of p.
+// For plan purchases the membership debit is reversed first, and a full
+// refund cancels the membership until the gateway settles it.
+func issueRefund(p Payment, amount float64, reason string, actor string) (Refund, error) {
+	var r Refund
+
+	id, err := generateRandomString(23)
+	if err != nil {
+		return r, err
+	}
+
+	r = Refund{
+		PaymentID:   p.ID,
+		UserUUID:    p.UserUUID,
+		RefundID:    "VMR" + id,
+		Amount:      roundAmount(amount),
+		Status:      PaymentPending,
+		Reason:      reason,
+		RequestedBy: actor,
+	}
+
+	tx := db.Begin()
+
+	// Serialises refunds of the same payment
+	if tx.Set("gorm:query_option", "FOR UPDATE").Where("id = ? AND status = ?", p.ID, PaymentSuccess).First(&p).RecordNotFound() {
+		tx.Rollback()
+		return r, errors.New("Only successful payments can be refunded")
+	}
+
+	refunded := getRefundedAmount(tx, p.ID)
+	if r.Amount <= 0 || roundAmount(refunded+r.Amount) > p.Amount {
+		tx.Rollback()
+		return r, errRefundExceedsPayment
+	}
+
+	if p.PlanID != 0 {
+		_, err = postLedgerEntry(tx, p.UserUUID, LedgerRefund, r.Amount, "reversal:"+r.RefundID, "Membership refund")
+
+		if err == nil && roundAmount(refunded+r.Amount) == p.Amount {
+			err = tx.Model(&Subscription{}).Where("reference = ?", "subscription:payment:"+strconv.Itoa(int(p.ID))).Updates(map[string]interface{}{"status": SubscriptionCancelled}).Error
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return r, err
+		}
+	}
+
+	_, err = postLedgerEntry(tx, p.UserUUID, LedgerRefund, -r.Amount, "refund:"+r.RefundID, "Refund of payment "+p.TransactionID)
+	if err == nil {
+		err = tx.Create(&r).Error
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return r, err
+	}
+
+	err = tx.Commit().Error
+	if err != nil {
+		return r, err
+	}
+
+	s, err := paymentGateway.refund(GatewayRefund{RefundID: r.RefundID, TransactionID: p.TransactionID, UserUUID: p.UserUUID, Amount: r.Amount})
+	if err != nil {
+		// Left pending; settleRefunds asks the gateway again
+		log.Println("Error while requesting refund: ", err.Error())
+		return r, nil
+	}
+
+	return r, r.finish(s)
+}
+
+// finish records the gateway's final answer. A failed refund puts the
+// credits back in the wallet; for plan purchases the membership is
+// reinstated and paid for with them again.
+func (r *Refund) finish(s GatewayStatus) error {
+	if s.Status == PaymentPending {
+		return nil
+	}
+
+	tx := db.Begin()
+
+	res := tx.Model(&Refund{}).Where("id = ? AND status = ?", r.ID, PaymentPending).Updates(map[string]interface{}{
+		"status":  s.Status,
+		"code":    s.Code,
+		"message": s.Message,
+	})
+	if res.Error != nil || res.RowsAffected == 0 {
+		tx.Rollback()
+		return res.Error
+	}
+
+	if s.Status == PaymentFailed {
+		var p Payment
+
+		tx.Where("id = ?", r.PaymentID).First(&p)
+
+		_, err := postLedgerEntry(tx, r.UserUUID, LedgerAdjustment, r.Amount, "refund-failed:"+r.RefundID, "Refund failed")
+		if err == errDuplicateLedgerEntry {
+			err = nil
+		}
+
+		if err == nil && p.PlanID != 0 {
+			_, err = postLedgerEntry(tx, r.UserUUID, LedgerDebit, -r.Amount, "refund-failed:subscription:"+r.RefundID, "Membership reinstated")
+			if err == errDuplicateLedgerEntry {
+				err = nil
+			}
+
+			// Only refunds cancel subscriptions
+			if err == nil {
+				err = tx.Model(&Subscription{}).Where("reference = ? AND status = ?", "subscription:payment:"+strconv.Itoa(int(p.ID)), SubscriptionCancelled).Updates(map[string]interface{}{"status": SubscriptionActive}).Error
+			}
+		}
+
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	err := tx.Commit().Error
+	if err != nil {
+		return err
+	}
+
+	r.Status = s.Status
+	r.Code = s.Code
+	r.Message = s.Message
+
+	return nil
+}
+
+func (r *Refund) settle() error {
+	if r.Status != PaymentPending {
+		return nil
+	}
+
+	s, err := paymentGateway.checkStatus(r.RefundID)
+	if err != nil {
+		return err
+	}
+
+	return r.finish(s)
+}
+
+// settleRefunds checks refunds the gateway has not confirmed yet.
+func settleRefunds() {
+	var rr []Refund
+
+	db.Where("status = ? AND created_at < ?", PaymentPending, time.Now().Add(-10*time.Minute)).Find(&rr)
+
+	for _, r := range rr {
+		err := r.settle()
+		if err != nil {
+			log.Println("Error while checking refund status: ", err.Error())
+		}
+	}
+}
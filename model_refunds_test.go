@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+// unreachableRefundGateway leaves every refund pending, so the test decides
+// how it ends.
+type unreachableRefundGateway struct {
+	*fakeGateway
+}
+
+func (g unreachableRefundGateway) refund(r GatewayRefund) (GatewayStatus, error) {
+	return GatewayStatus{}, errors.New("Gateway unreachable")
+}
+
+func createTestPlan(t *testing.T) Plan {
+	t.Helper()
+
+	code := newTestUserUUID()
+
+	p := Plan{Code: code, Name: "Test", Price: 100, DurationDays: 30, Active: true}
+
+	err := db.Create(&p).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// refundTestPayment settles p and refunds all of it. The refund stays
+// pending.
+func refundTestPayment(t *testing.T, gw *fakeGateway, p Payment) Refund {
+	t.Helper()
+
+	err := p.settle()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	paymentGateway = unreachableRefundGateway{gw}
+
+	r, err := issueRefund(getTestPayment(t, p.ID), p.Amount, "Test", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if r.Status != PaymentPending {
+		t.Fatalf("got refund status %s, want %s", r.Status, PaymentPending)
+	}
+
+	return r
+}
+
+func TestFailedRefundRestoresCredits(t *testing.T) {
+	setupTestDB(t)
+	gw := useFakeGateway(t)
+
+	r := refundTestPayment(t, gw, createTestPayment(t, gw, 100, 100))
+
+	if b := getTestBalance(t, r.UserUUID); b != 0 {
+		t.Errorf("got balance %.2f while refunding, want 0", b)
+	}
+
+	err := r.finish(GatewayStatus{Status: PaymentFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := getTestBalance(t, r.UserUUID); b != 100 {
+		t.Errorf("got balance %.2f, want 100", b)
+	}
+}
+
+func TestFailedRefundReinstatesMembership(t *testing.T) {
+	setupTestDB(t)
+	gw := useFakeGateway(t)
+
+	plan := createTestPlan(t)
+
+	p := createTestPayment(t, gw, plan.Price, plan.Price)
+	db.Model(&Payment{}).Where("id = ?", p.ID).UpdateColumn("plan_id", plan.ID)
+	p.PlanID = plan.ID
+
+	r := refundTestPayment(t, gw, p)
+
+	var s Subscription
+
+	reference := "subscription:payment:" + strconv.Itoa(int(p.ID))
+
+	db.Where("reference = ?", reference).First(&s)
+	if s.Status != SubscriptionCancelled {
+		t.Errorf("got subscription status %s while refunding, want %s", s.Status, SubscriptionCancelled)
+	}
+
+	err := r.finish(GatewayStatus{Status: PaymentFailed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Where("reference = ?", reference).First(&s)
+	if s.Status != SubscriptionActive {
+		t.Errorf("got subscription status %s, want %s", s.Status, SubscriptionActive)
+	}
+
+	// The membership is paid for again, so nothing is left in the wallet
+	if b := getTestBalance(t, r.UserUUID); b != 0 {
+		t.Errorf("got balance %.2f, want 0", b)
+	}
+}
@@ -22,10 +22,28 @@ type SearchQuery struct {
 	IncomeTo        float64  `json:"income_to"`
 	Professions     []string `json:"profession"`
 	Educations      []string `json:"educations"`
-	Order           string   `json:"order"`
-	OrderBy         string   `json:"order_by"`
-	Page            uint     `json:"page"`
-	Limit           int      `json:"limit"`
+	Degrees         []string `json:"degrees"`
+
+	ProfessionCategories []string `json:"profession_categories"`
+	EmploymentTypes      []string `json:"employment_types"`
+	Employers            []string `json:"employers"`
+	FamilyTypes          []string `json:"family_types"`
+	NativePlaces         []string `json:"native_places"`
+
+	HeightFrom    uint     `json:"height_from"`
+	HeightTo      uint     `json:"height_to"`
+	Complexions   []string `json:"complexions"`
+	Diets         []string `json:"diets"`
+	Smoking       []string `json:"smoking"`
+	Drinking      []string `json:"drinking"`
+	MotherTongues []string `json:"mother_tongues"`
+	Religions     []string `json:"religions"`
+	Disabilities  []string `json:"disabilities"`
+
+	Order   string `json:"order"`
+	OrderBy string `json:"order_by"`
+	Page    uint   `json:"page"`
+	Limit   int    `json:"limit"`
 
 	UserUUID []string `json:"user_uuids"`
 }
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+const (
+	VerificationKindSelfie = "selfie"
+
+	// VerificationChallenged is a selfie verification waiting for the member
+	// to take the selfie.
+	VerificationChallenged = "challenged"
+)
+
+// Gestures the member is asked to make in their selfie, so a photo taken
+// from elsewhere cannot be used.
+var selfieGestures = []string{
+	"thumbs_up",
+	"peace_sign",
+	"touch_nose",
+	"hand_on_head",
+	"three_fingers",
+	"cover_left_eye",
+	"ok_sign",
+	"wave",
+}
+
+const selfieChallengeTTL = 10 * time.Minute
+
+func pickSelfieGesture() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(len(selfieGestures))))
+	if err != nil {
+		return "", err
+	}
+
+	return selfieGestures[n.Int64()], nil
+}
+
+// getPrimaryPhoto returns the approved photo a selfie is compared with.
+func getPrimaryPhoto(userUUID string) (Media, bool) {
+	var m Media
+
+	found := !db.Where("user_uuid = ? AND is_primary = ? AND status = ?", userUUID, true, MediaApproved).First(&m).RecordNotFound()
+
+	return m, found
+}
+
+// isSelfiePhotoCurrent reports whether the photo a selfie was compared with
+// is still the member's approved primary photo, with the same content.
+func isSelfiePhotoCurrent(v Verification) bool {
+	var count int
+
+	db.Model(&Media{}).Where("id = ? AND user_uuid = ? AND is_primary = ? AND status = ? AND path = ?",
+		v.MediaID, v.UserUUID, true, MediaApproved, v.MediaPath).Count(&count)
+
+	return v.MediaPath != "" && count > 0
+}
+
+func selfieChallenge(ctx echo.Context) error {
+	var count int
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	db.Model(&UserBadge{}).Where("user_uuid = ? AND type = ?", u.UUID, BadgePhoto).Count(&count)
+	if count > 0 {
+		return ctx.JSON(http.StatusConflict, gettext("Your photo is already verified", ctx))
+	}
+
+	db.Model(&Verification{}).Where("user_uuid = ? AND kind = ? AND status = ?", u.UUID, VerificationKindSelfie, VerificationPending).Count(&count)
+	if count > 0 {
+		return ctx.JSON(http.StatusConflict, gettext("Your selfie is already being reviewed", ctx))
+	}
+
+	if _, found := getPrimaryPhoto(u.UUID); !found {
+		return ctx.JSON(http.StatusBadRequest, gettext("You need an approved primary photo first", ctx))
+	}
+
+	gesture, err := pickSelfieGesture()
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to start verification", ctx))
+	}
+
+	// Only the latest challenge can be answered
+	db.Where("user_uuid = ? AND kind = ? AND status = ?", u.UUID, VerificationKindSelfie, VerificationChallenged).Delete(&Verification{})
+
+	v := Verification{
+		UserUUID:           u.UUID,
+		Kind:               VerificationKindSelfie,
+		Status:             VerificationChallenged,
+		Gesture:            gesture,
+		ChallengeExpiresAt: sql.NullTime{Time: time.Now().Add(selfieChallengeTTL), Valid: true},
+	}
+
+	err = db.Create(&v).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to start verification", ctx))
+	}
+
+	return ctx.JSON(http.StatusCreated, v)
+}
+
+func submitSelfie(ctx echo.Context) error {
+	var v Verification
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	if db.Where("uuid = ? AND user_uuid = ? AND kind = ?", ctx.Param("uuid"), u.UUID, VerificationKindSelfie).First(&v).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if v.Status != VerificationChallenged {
+		return ctx.JSON(http.StatusConflict, gettext("This selfie has already been submitted", ctx))
+	}
+
+	if !v.ChallengeExpiresAt.Valid || v.ChallengeExpiresAt.Time.Before(time.Now()) {
+		return ctx.JSON(http.StatusGone, gettext("This gesture has expired, please start again", ctx))
+	}
+
+	photo, found := getPrimaryPhoto(u.UUID)
+	if !found {
+		return ctx.JSON(http.StatusBadRequest, gettext("You need an approved primary photo first", ctx))
+	}
+
+	data, contentType, ext, err := readVerificationFile(ctx, "selfie")
+	if err != nil || contentType == "application/pdf" {
+		return ctx.JSON(http.StatusBadRequest, gettext("Selfie must be a photo", ctx))
+	}
+
+	key, err := storeVerificationFile(data, contentType, ext)
+	if err != nil {
+		log.Println("Error while storing selfie: ", err.Error())
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to upload selfie", ctx))
+	}
+
+	res := db.Model(&Verification{}).Where("id = ? AND status = ?", v.ID, VerificationChallenged).Updates(map[string]interface{}{
+		"path":       key,
+		"media_id":   photo.ID,
+		"media_path": photo.Path,
+		"status":     VerificationPending,
+	})
+	if res.Error != nil || res.RowsAffected == 0 {
+		blobStore.delete(key)
+		return ctx.JSON(http.StatusConflict, gettext("This selfie has already been submitted", ctx))
+	}
+
+	db.Where("id = ?", v.ID).First(&v)
+
+	go scoreSelfie(v, photo)
+
+	return ctx.JSON(http.StatusCreated, v)
+}
+
+// scoreSelfie asks the face scorer to compare the selfie with the photo it
+// was taken against.
+func scoreSelfie(v Verification, photo Media) {
+	selfie, err := readBlob(v.Path)
+	if err != nil {
+		return
+	}
+
+	profile, err := readBlob(photo.getKey(RenditionFull))
+	if err != nil {
+		return
+	}
+
+	score, ok, err := faceScorer.score(selfie, profile)
+	if err != nil {
+		log.Println("Error while scoring selfie: ", err.Error())
+		return
+	}
+
+	if ok {
+		db.Model(&Verification{}).Where("id = ?", v.ID).Updates(map[string]interface{}{"face_score": score})
+	}
+}
+
+func readBlob(key string) ([]byte, error) {
+	r, err := blobStore.get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	defer r.Close()
+
+	return ioutil.ReadAll(r)
+}
@@ -40,6 +40,9 @@ func verifySession(ctx echo.Context) (User, error) {
 	}
 
 	err = db.Model(&User{}).Where("id = ?", s.UserID).First(&u).Error
+	if err != nil {
+		return u, err
+	}
 
-	return u, err
+	return u, u.checkStanding(ctx)
 }
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+type Shortlist struct {
+	ID          uint   `gorm:"primary_key" json:"-"`
+	UserUUID    string `gorm:"type:uuid;unique_index:idx_shortlists_pair" json:"-"`
+	ProfileUUID string `gorm:"type:uuid;unique_index:idx_shortlists_pair" json:"profile_uuid"`
+	Note        string `json:"note"`
+
+	Profile *ProfileCard `gorm:"-" json:"profile,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (s *Shortlist) sanitize(ctx echo.Context) {
+	s.Note = sanitizeText(s.Note, 1000)
+}
+
+func (s *Shortlist) validate(ctx echo.Context) error {
+	if s.ProfileUUID == "" {
+		return errors.New(gettext("Profile UUID is required", ctx))
+	}
+
+	if s.ProfileUUID == s.UserUUID {
+		return errors.New(gettext("You cannot shortlist yourself", ctx))
+	}
+
+	if db.Where("uuid = ?", s.ProfileUUID).First(&User{}).RecordNotFound() {
+		return errors.New(gettext("User not found", ctx))
+	}
+
+	return nil
+}
+
+func shortlist(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var ss []Shortlist
+
+	excludeBlocked(db, u.UUID, "profile_uuid").Where("user_uuid = ?", u.UUID).Order("created_at DESC").Find(&ss)
+
+	uuids := make([]string, 0, len(ss))
+	for _, s := range ss {
+		uuids = append(uuids, s.ProfileUUID)
+	}
+
+	cards := getProfileCards(u.UUID, uuids)
+	for i, s := range ss {
+		if c, ok := cards[s.ProfileUUID]; ok {
+			ss[i].Profile = &c
+		}
+	}
+
+	return ctx.JSON(http.StatusOK, ss)
+}
+
+// addToShortlist shortlists a profile, or updates the note if it already is.
+func addToShortlist(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var req, s Shortlist
+
+	// Populate object from JSON
+	err = ctx.Bind(&req)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	req.UserUUID = u.UUID
+
+	req.sanitize(ctx)
+	err = req.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	db.Where("user_uuid = ? AND profile_uuid = ?", req.UserUUID, req.ProfileUUID).First(&s)
+	s.UserUUID = req.UserUUID
+	s.ProfileUUID = req.ProfileUUID
+	s.Note = req.Note
+
+	err = db.Save(&s).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to save shortlist", ctx))
+	}
+
+	return ctx.JSON(http.StatusOK, s)
+}
+
+func removeFromShortlist(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = db.Where("user_uuid = ? AND profile_uuid = ?", u.UUID, ctx.Param("uuid")).Delete(&Shortlist{}).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to remove from shortlist", ctx))
+	}
+
+	return ctx.NoContent(http.StatusOK)
+}
@@ -73,3 +73,34 @@ func updateOTPStatus(ctx echo.Context) error {
 
 	return nil
 }
+
+// confirmOTP checks the code sent to the member's phone and grants the phone
+// badge.
+func confirmOTP(ctx echo.Context) error {
+	var (
+		s    SMS
+		data struct {
+			OTP string `json:"otp"`
+		}
+	)
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	if data.OTP == "" || db.Where("to_user_uuid = ? AND to_mobile = ? AND type = ? AND valid_till > NOW()", u.UUID, u.Phone, "otp").Order("id DESC").First(&s).RecordNotFound() || s.Message != data.OTP {
+		return ctx.JSON(http.StatusBadRequest, gettext("Verification code is invalid", ctx))
+	}
+
+	db.Model(&s).Updates(map[string]interface{}{"status": "verified", "valid_till": time.Now()})
+
+	grantBadge(u.UUID, BadgePhone, 0, "")
+
+	return ctx.JSON(http.StatusOK, gettext("Your phone number has been verified", ctx))
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+const (
+	SubscriptionActive    = "active"
+	SubscriptionExpired   = "expired"
+	SubscriptionCancelled = "cancelled"
+)
+
+// Subscription is one paid period of a plan. A renewal bought before the
+// current period ends starts when it ends, so a member can have queued
+// subscriptions.
+type Subscription struct {
+	Model
+
+	UserUUID       string       `gorm:"type:uuid;index" json:"-"`
+	PlanID         uint         `gorm:"index" json:"-"`
+	Status         string       `gorm:"index" json:"status"`
+	StartsAt       time.Time    `json:"starts_at"`
+	EndsAt         time.Time    `gorm:"index" json:"ends_at"`
+	UnlocksUsed    int          `json:"unlocks_used"`
+	Reference      string       `gorm:"unique_index" json:"-"`
+	ReminderSentAt sql.NullTime `json:"-"`
+
+	Plan Plan `gorm:"-" json:"plan"`
+}
+
+func getSubscriptionReminderDays() int {
+	days, err := strconv.Atoi(os.Getenv("VM_SUBSCRIPTION_REMINDER_DAYS"))
+	if err != nil || days <= 0 {
+		days = 3
+	}
+
+	return days
+}
+
+func (s *Subscription) loadPlan() {
+	db.Unscoped().Where("id = ?", s.PlanID).First(&s.Plan)
+}
+
+// getActiveSubscription returns the subscription covering the current time.
+func getActiveSubscription(userUUID string) (Subscription, bool) {
+	var s Subscription
+
+	if db.Where("user_uuid = ? AND status = ? AND starts_at <= NOW() AND ends_at > NOW()", userUUID, SubscriptionActive).Order("starts_at ASC").First(&s).RecordNotFound() {
+		return s, false
+	}
+
+	s.loadPlan()
+
+	return s, true
+}
+
+func hasPlanFeature(userUUID string, feature string) bool {
+	s, ok := getActiveSubscription(userUUID)
+
+	return ok && s.Plan.allows(feature)
+}
+
+// premiumOnly rejects members whose current plan does not include feature.
+func premiumOnly(feature string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(ctx echo.Context) error {
+			u, err := verifySession(ctx)
+			if err != nil {
+				return ctx.JSON(http.StatusUnauthorized, err.Error())
+			}
+
+			if !hasPlanFeature(u.UUID, feature) {
+				return ctx.JSON(http.StatusPaymentRequired, gettext("This feature requires a premium membership", ctx))
+			}
+
+			return next(ctx)
+		}
+	}
+}
+
+// activateSubscription adds a period of the plan within tx, starting now or
+// when the member's last queued subscription ends.
+func activateSubscription(tx *gorm.DB, userUUID string, p Plan, reference string) (Subscription, error) {
+	var last Subscription
+
+	start := time.Now()
+
+	if !tx.Where("user_uuid = ? AND status = ? AND ends_at > NOW()", userUUID, SubscriptionActive).Order("ends_at DESC").First(&last).RecordNotFound() {
+		start = last.EndsAt
+	}
+
+	s := Subscription{
+		UserUUID:  userUUID,
+		PlanID:    p.ID,
+		Status:    SubscriptionActive,
+		StartsAt:  start,
+		EndsAt:    start.AddDate(0, 0, p.DurationDays),
+		Reference: reference,
+		Plan:      p,
+	}
+
+	err := tx.Create(&s).Error
+
+	return s, err
+}
+
+// useContactUnlock consumes one unlock from the plan quota within tx. It
+// returns false when the member has no quota left.
+func useContactUnlock(tx *gorm.DB, userUUID string) bool {
+	s, ok := getActiveSubscription(userUUID)
+	if !ok || s.Plan.ContactUnlocks == 0 {
+		return false
+	}
+
+	res := tx.Exec("UPDATE subscriptions SET unlocks_used = unlocks_used + 1 WHERE id = ? AND unlocks_used < ?", s.ID, s.Plan.ContactUnlocks)
+
+	return res.Error == nil && res.RowsAffected == 1
+}
+
+func subscriptions(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var ss []Subscription
+
+	db.Where("user_uuid = ?", u.UUID).Order("starts_at DESC").Find(&ss)
+
+	for i := range ss {
+		ss[i].loadPlan()
+	}
+
+	return ctx.JSON(http.StatusOK, ss)
+}
+
+// buySubscription pays for a plan from the wallet. Plans can also be bought
+// directly through the gateway, see createPaymentOrder.
+func buySubscription(ctx echo.Context) error {
+	var (
+		c    Coupon
+		data struct {
+			PlanCode   string `json:"plan_code"`
+			CouponCode string `json:"coupon_code"`
+		}
+	)
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	p, err := getActivePlan(data.PlanCode)
+	if err != nil {
+		return ctx.JSON(http.StatusNotFound, gettext("Plan not found", ctx))
+	}
+
+	price := p.Price
+
+	if data.CouponCode != "" {
+		c, err = checkCoupon(ctx, data.CouponCode, u.UUID, p)
+		if err != nil {
+			return ctx.JSON(http.StatusBadRequest, err.Error())
+		}
+
+		price = roundAmount(price - c.discountFor(p))
+	}
+
+	id, err := generateRandomString(16)
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to buy plan", ctx))
+	}
+
+	reference := "subscription:" + id
+
+	tx := db.Begin()
+
+	if price > 0 {
+		_, err = postLedgerEntry(tx, u.UUID, LedgerDebit, -price, reference, p.Name+" membership")
+		if err == errInsufficientBalance {
+			tx.Rollback()
+			return ctx.JSON(http.StatusPaymentRequired, gettext("You do not have enough credits in your wallet", ctx))
+		}
+	}
+
+	if err == nil && c.ID != 0 {
+		err = redeemCoupon(tx, c.ID, u.UUID, roundAmount(p.Price-price), reference)
+		if err == errCouponUnavailable {
+			tx.Rollback()
+			return ctx.JSON(http.StatusConflict, gettext("This coupon is no longer available", ctx))
+		}
+	}
+
+	var s Subscription
+	if err == nil {
+		s, err = activateSubscription(tx, u.UUID, p, reference)
+	}
+
+	if err != nil {
+		tx.Rollback()
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to buy plan", ctx))
+	}
+
+	tx.Commit()
+
+	return ctx.JSON(http.StatusCreated, s)
+}
+
+// remindExpiringSubscriptions tells members whose membership is about to end
+// without a renewal queued.
+func remindExpiringSubscriptions() {
+	var ss []Subscription
+
+	db.Where(`status = ? AND ends_at BETWEEN NOW() AND ? AND reminder_sent_at IS NULL
+		AND NOT EXISTS (SELECT 1 FROM subscriptions r WHERE r.user_uuid = subscriptions.user_uuid AND r.status = ? AND r.starts_at >= subscriptions.ends_at AND r.deleted_at IS NULL)`,
+		SubscriptionActive, time.Now().AddDate(0, 0, getSubscriptionReminderDays()), SubscriptionActive).Find(&ss)
+
+	for _, s := range ss {
+		var u User
+
+		db.Model(&Subscription{}).Where("id = ?", s.ID).Updates(map[string]interface{}{"reminder_sent_at": time.Now()})
+
+		if db.Where("uuid = ?", s.UserUUID).First(&u).RecordNotFound() {
+			continue
+		}
+
+		s.loadPlan()
+
+		n := Notification{ReceiverID: u.UUID, ReferenceID: MembershipExpiring}
+		n.createAndSend()
+
+		vars := map[string]string{
+			"plan_name": s.Plan.Name,
+			"ends_at":   s.EndsAt.Format("02 Jan 2006"),
+		}
+
+		err := u.notify("user-subscription-expiring", string(u.Email), vars, nil)
+		if err != nil {
+			log.Println("Error while sending subscription reminder: ", err.Error())
+		}
+	}
+
+	log.Printf("Sent %d subscription reminders", len(ss))
+}
+
+// expireSubscriptions ends lapsed subscriptions. Members without another
+// period are back on the free plan and are told so.
+func expireSubscriptions() {
+	var ss []Subscription
+
+	db.Where("status = ? AND ends_at <= NOW()", SubscriptionActive).Find(&ss)
+
+	for _, s := range ss {
+		err := db.Model(&Subscription{}).Where("id = ?", s.ID).Updates(map[string]interface{}{"status": SubscriptionExpired}).Error
+		if err != nil {
+			log.Println("Error while expiring subscription: ", err.Error())
+			continue
+		}
+
+		if _, ok := getActiveSubscription(s.UserUUID); !ok {
+			n := Notification{ReceiverID: s.UserUUID, ReferenceID: MembershipExpired}
+			n.createAndSend()
+		}
+	}
+
+	log.Printf("Expired %d subscriptions", len(ss))
+}
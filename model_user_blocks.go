@@ -0,0 +1,137 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/labstack/echo"
+)
+
+type UserBlock struct {
+	ID          uint   `gorm:"primary_key" json:"-"`
+	BlockerUUID string `gorm:"type:uuid;unique_index:idx_user_blocks_pair" json:"-"`
+	BlockedUUID string `gorm:"type:uuid;index;unique_index:idx_user_blocks_pair" json:"blocked_uuid"`
+
+	Profile *ProfileCard `gorm:"-" json:"profile,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (b *UserBlock) validate(ctx echo.Context) error {
+	if b.BlockedUUID == "" {
+		return errors.New(gettext("User UUID is required", ctx))
+	}
+
+	if b.BlockedUUID == b.BlockerUUID {
+		return errors.New(gettext("You cannot block yourself", ctx))
+	}
+
+	if db.Where("uuid = ?", b.BlockedUUID).First(&User{}).RecordNotFound() {
+		return errors.New(gettext("User not found", ctx))
+	}
+
+	return nil
+}
+
+// isBlocked reports whether either member has blocked the other.
+func isBlocked(a string, b string) bool {
+	var count int
+
+	if a == "" || b == "" {
+		return false
+	}
+
+	db.Model(&UserBlock{}).Where("(blocker_uuid = ? AND blocked_uuid = ?) OR (blocker_uuid = ? AND blocked_uuid = ?)", a, b, b, a).Count(&count)
+
+	return count > 0
+}
+
+// excludeBlocked filters out rows whose column holds a member that has blocked,
+// or was blocked by, the given member.
+func excludeBlocked(dbQuery *gorm.DB, uuid string, column string) *gorm.DB {
+	if uuid == "" {
+		return dbQuery
+	}
+
+	return dbQuery.Where(column+"::text NOT IN (SELECT blocked_uuid::text FROM user_blocks WHERE blocker_uuid = ? UNION SELECT blocker_uuid::text FROM user_blocks WHERE blocked_uuid = ?)", uuid, uuid)
+}
+
+func blocks(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var bb []UserBlock
+
+	db.Where("blocker_uuid = ?", u.UUID).Order("created_at DESC").Find(&bb)
+
+	uuids := make([]string, 0, len(bb))
+	for _, b := range bb {
+		uuids = append(uuids, b.BlockedUUID)
+	}
+
+	var uu []User
+	db.Where("uuid IN (?)", getUnique(uuids)).Find(&uu)
+
+	// Blocked members only show up with their public card
+	cards := make(map[string]ProfileCard, len(uu))
+	for _, u := range uu {
+		c := newProfileCard(u)
+		c.applyPrivacy(u, profileAccess{})
+		cards[u.UUID] = c
+	}
+
+	for i, b := range bb {
+		if c, ok := cards[b.BlockedUUID]; ok {
+			bb[i].Profile = &c
+		}
+	}
+
+	return ctx.JSON(http.StatusOK, bb)
+}
+
+func blockUser(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var b UserBlock
+
+	// Populate object from JSON
+	err = ctx.Bind(&b)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	b.BlockerUUID = u.UUID
+
+	err = b.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	err = db.Where(UserBlock{BlockerUUID: b.BlockerUUID, BlockedUUID: b.BlockedUUID}).FirstOrCreate(&b).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to block user", ctx))
+	}
+
+	return ctx.JSON(http.StatusCreated, b)
+}
+
+func unblockUser(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	err = db.Where("blocker_uuid = ? AND blocked_uuid = ?", u.UUID, ctx.Param("uuid")).Delete(&UserBlock{}).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to unblock user", ctx))
+	}
+
+	return ctx.NoContent(http.StatusOK)
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
 
 	"github.com/labstack/echo"
 )
@@ -22,8 +25,28 @@ type UserData struct {
 	Unsubscribed bool `json:"unsubscribed"`
 
 	FamilyInfo      FamilyInfo      `gorm:"type:jsonb" json:"family_info"`
-	EducationalInfo EducationalInfo `gorm:"type:jsonb" json:"educationl_info"`
+	EducationalInfo EducationalInfo `gorm:"type:jsonb" json:"educational_info"`
+	CareerInfo      CareerInfo      `gorm:"type:jsonb" json:"career_info"`
 	OtherInfo       OtherInfo       `gorm:"type:jsonb" json:"other_info"`
+
+	// Deprecated: older clients read and write educational info under this
+	// misspelt key. Use EducationalInfo.
+	LegacyEducationalInfo *EducationalInfo `gorm:"-" json:"educationl_info,omitempty"`
+}
+
+// applyLegacyEducationalInfo takes educational info sent under the old key,
+// unless the client changed it under the new one too.
+func (u *UserData) applyLegacyEducationalInfo(stored EducationalInfo) {
+	if u.LegacyEducationalInfo != nil && (reflect.DeepEqual(u.EducationalInfo, stored) || reflect.DeepEqual(u.EducationalInfo, EducationalInfo{})) {
+		u.EducationalInfo = *u.LegacyEducationalInfo
+	}
+
+	u.setLegacyEducationalInfo()
+}
+
+func (u *UserData) setLegacyEducationalInfo() {
+	info := u.EducationalInfo
+	u.LegacyEducationalInfo = &info
 }
 
 func (u *UserData) sanitize(ctx echo.Context) {
@@ -42,6 +65,10 @@ func (u *UserData) sanitize(ctx echo.Context) {
 	u.State = sanitizeText(u.State, 100)
 
 	u.PostalCode = sanitizeText(u.PostalCode, 16)
+
+	u.FamilyInfo.sanitize()
+	u.EducationalInfo.sanitize()
+	u.CareerInfo.sanitize()
 }
 
 func (u *UserData) validate(ctx echo.Context, skipRequiredCheck bool) error {
@@ -70,5 +97,85 @@ func (u *UserData) validate(ctx echo.Context, skipRequiredCheck bool) error {
 		return errors.New("Postal Code is required")
 	}
 
-	return nil
+	err := u.FamilyInfo.validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = u.EducationalInfo.validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	return u.CareerInfo.validate(ctx)
+}
+
+// setLegacyString fills dst from the first of keys found in a jsonb value
+// saved before the profile schema was typed.
+func setLegacyString(dst *string, legacy map[string]interface{}, keys ...string) {
+	if *dst != "" {
+		return
+	}
+
+	for _, k := range keys {
+		switch v := legacy[k].(type) {
+		case string:
+			*dst = sanitizeText(v, 100)
+		case float64:
+			*dst = fmt.Sprint(v)
+		}
+
+		if *dst != "" {
+			return
+		}
+	}
+}
+
+func setLegacyUint(dst *uint, legacy map[string]interface{}, keys ...string) {
+	if *dst != 0 {
+		return
+	}
+
+	for _, k := range keys {
+		switch v := legacy[k].(type) {
+		case string:
+			n, err := strconv.ParseUint(v, 10, 32)
+			if err == nil {
+				*dst = uint(n)
+			}
+		case float64:
+			if v > 0 {
+				*dst = uint(v)
+			}
+		}
+
+		if *dst != 0 {
+			return
+		}
+	}
+}
+
+// migrateProfileInfo rewrites family and educational info in the typed
+// schema. The original values are kept in profile_info_backups, whose
+// existence also marks the migration as done.
+func migrateProfileInfo() {
+	if db.HasTable("profile_info_backups") {
+		return
+	}
+
+	err := db.Exec("CREATE TABLE profile_info_backups AS SELECT uuid, family_info, educational_info, NOW() AS created_at FROM users").Error
+	if err != nil {
+		return
+	}
+
+	var uu []User
+
+	db.Unscoped().Select("id, family_info, educational_info").Where("family_info IS NOT NULL OR educational_info IS NOT NULL").Find(&uu)
+
+	for _, u := range uu {
+		db.Unscoped().Model(&User{}).Where("id = ?", u.ID).UpdateColumns(map[string]interface{}{
+			"family_info":      u.FamilyInfo,
+			"educational_info": u.EducationalInfo,
+		})
+	}
 }
@@ -1,27 +1,52 @@
 package main
 
 import (
+	"database/sql"
 	"errors"
+	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/labstack/echo"
 )
 
+const (
+	InterestSent      = "sent"
+	InterestAccepted  = "accepted"
+	InterestDeclined  = "declined"
+	InterestWithdrawn = "withdrawn"
+	InterestExpired   = "expired"
+)
+
 type UserInterest struct {
-	ID           uint   `gorm:"primary_key" json:"-"`
-	FromUserUUID string `json:"from_user_uuid"`
-	ToUserUUID   string `json:"to_user_uuid"`
-	Type         string `json:"type"`
-	UserInfo     User   `gorm:"-"`
+	ID           uint         `gorm:"primary_key" json:"-"`
+	FromUserUUID string       `json:"from_user_uuid"`
+	ToUserUUID   string       `json:"to_user_uuid"`
+	Type         string       `json:"type"`
+	Status       string       `gorm:"index" json:"status"`
+	SentAt       sql.NullTime `json:"sent_at"`
+	RespondedAt  sql.NullTime `json:"responded_at"`
+	UserInfo     ProfileCard  `gorm:"-"`
 
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"deleted_at"`
 }
 
+// interestTransitions lists the states an interest may move to from each state.
+var interestTransitions = map[string][]string{
+	"":                {InterestSent},
+	InterestSent:      {InterestAccepted, InterestDeclined, InterestWithdrawn, InterestExpired},
+	InterestAccepted:  {InterestWithdrawn},
+	InterestDeclined:  {InterestSent},
+	InterestWithdrawn: {InterestSent},
+	InterestExpired:   {InterestSent},
+}
+
 func (u *UserInterest) sanitize(ctx echo.Context) {
 	u.Type = sanitizeText(u.Type, 64)
 }
@@ -43,6 +68,99 @@ func (u *UserInterest) validate(ctx echo.Context, skipRequiredCheck bool) error
 	return nil
 }
 
+func getInterestExpiry() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("VM_INTEREST_EXPIRY_DAYS"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+
+	return time.Hour * 24 * time.Duration(days)
+}
+
+func getInterestCooldown() time.Duration {
+	days, err := strconv.Atoi(os.Getenv("VM_INTEREST_COOLDOWN_DAYS"))
+	if err != nil || days < 0 {
+		days = 30
+	}
+
+	return time.Hour * 24 * time.Duration(days)
+}
+
+func isMatch(ui UserInterest) bool {
+	return ui.Status == InterestAccepted
+}
+
+func (u *UserInterest) canTransition(to string) bool {
+	return isOneOf(to, interestTransitions[u.Status])
+}
+
+// transition moves the interest to the given state, saves it and notifies the
+// other member.
+func (u *UserInterest) transition(ctx echo.Context, to string) error {
+	if !u.canTransition(to) {
+		return fmt.Errorf(gettext("An interest cannot be %s once it is %s", ctx), to, u.Status)
+	}
+
+	if to == InterestSent && u.Status == InterestDeclined && u.RespondedAt.Valid {
+		if time.Now().Before(u.RespondedAt.Time.Add(getInterestCooldown())) {
+			return errors.New(gettext("This member declined your interest recently. Please try again later.", ctx))
+		}
+	}
+
+	u.Status = to
+
+	if to == InterestSent {
+		u.Type = "interested"
+		u.SentAt = sql.NullTime{Time: time.Now(), Valid: true}
+		u.RespondedAt.Valid = false
+	} else {
+		u.RespondedAt = sql.NullTime{Time: time.Now(), Valid: true}
+	}
+
+	err := db.Save(u).Error
+	if err != nil {
+		return errors.New(gettext("Unable to save interest", ctx))
+	}
+
+	// Notify from a copy, as callers may reuse u, e.g. as a loop variable
+	saved := *u
+	go saved.notify()
+
+	return nil
+}
+
+// notify pushes the new state to both members and sends the other member a
+// notification.
+func (u *UserInterest) notify() {
+	publishEvent(u.FromUserUUID, EventInterest, u)
+	publishEvent(u.ToUserUUID, EventInterest, u)
+
+	n := Notification{
+		SenderID:   u.FromUserUUID,
+		ReceiverID: u.ToUserUUID,
+	}
+
+	switch u.Status {
+	case InterestSent:
+		n.ReferenceID = PersonInterested
+	case InterestAccepted:
+		n.ReferenceID = PersonInterestAccepted
+		n.SenderID, n.ReceiverID = u.ToUserUUID, u.FromUserUUID
+	case InterestDeclined:
+		n.ReferenceID = PersonInterestDeclined
+		n.SenderID, n.ReceiverID = u.ToUserUUID, u.FromUserUUID
+	case InterestWithdrawn:
+		n.ReferenceID = PersonInterestWithdrawn
+	case InterestExpired:
+		n.ReferenceID = PersonInterestExpired
+		n.SenderID, n.ReceiverID = u.ToUserUUID, u.FromUserUUID
+	default:
+		return
+	}
+
+	n.createAndSend()
+}
+
 func interests(ctx echo.Context) error {
 	u, err := verifySession(ctx)
 	if err != nil {
@@ -51,14 +169,16 @@ func interests(ctx echo.Context) error {
 
 	var uu []UserInterest
 
-	db.Where("from_user_uuid = ?", u.UUID).Find(&uu)
+	excludeBlocked(db, u.UUID, "to_user_uuid").Where("from_user_uuid = ?", u.UUID).Find(&uu)
 
-	if len(uu) > 0 {
-		for i, u := range uu {
-			db.Model(&User{}).Where("uuid = ?", u.ToUserUUID).First(&u.UserInfo)
-			db.Model(&Media{}).Where("user_uuid = ?", u.UserInfo.UUID).Find(&u.UserInfo.UserMedia)
-			uu[i] = u
-		}
+	uuids := make([]string, 0, len(uu))
+	for _, ui := range uu {
+		uuids = append(uuids, ui.ToUserUUID)
+	}
+
+	cards := getProfileCards(u.UUID, uuids)
+	for i, ui := range uu {
+		uu[i].UserInfo = cards[ui.ToUserUUID]
 	}
 
 	return ctx.JSON(http.StatusOK, uu)
@@ -72,19 +192,54 @@ func interested(ctx echo.Context) error {
 
 	var uu []UserInterest
 
-	db.Where("to_user_uuid = ?", u.UUID).Find(&uu)
+	excludeBlocked(db, u.UUID, "from_user_uuid").Where("to_user_uuid = ?", u.UUID).Where("COALESCE(status, '') != ?", InterestWithdrawn).Find(&uu)
 
-	if len(uu) > 0 {
-		for i, u := range uu {
-			db.Model(&User{}).Where("uuid = ?", u.FromUserUUID).First(&u.UserInfo)
-			db.Model(&Media{}).Where("user_uuid = ?", u.UserInfo.UUID).Find(&u.UserInfo.UserMedia)
-			uu[i] = u
-		}
+	uuids := make([]string, 0, len(uu))
+	for _, ui := range uu {
+		uuids = append(uuids, ui.FromUserUUID)
+	}
+
+	cards := getProfileCards(u.UUID, uuids)
+	for i, ui := range uu {
+		uu[i].UserInfo = cards[ui.FromUserUUID]
+	}
+
+	return ctx.JSON(http.StatusOK, uu)
+}
+
+func matches(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var uu []UserInterest
+
+	dbQuery := excludeBlocked(db, u.UUID, "from_user_uuid")
+	dbQuery = excludeBlocked(dbQuery, u.UUID, "to_user_uuid")
+	dbQuery.Where("(from_user_uuid = ? OR to_user_uuid = ?) AND status = ?", u.UUID, u.UUID, InterestAccepted).Order("responded_at DESC").Find(&uu)
+
+	uuids := make([]string, 0, len(uu))
+	for _, ui := range uu {
+		uuids = append(uuids, getOtherUserUUID(ui, u.UUID))
+	}
+
+	cards := getProfileCards(u.UUID, uuids)
+	for i, ui := range uu {
+		uu[i].UserInfo = cards[getOtherUserUUID(ui, u.UUID)]
 	}
 
 	return ctx.JSON(http.StatusOK, uu)
 }
 
+func getOtherUserUUID(ui UserInterest, uuid string) string {
+	if ui.FromUserUUID == uuid {
+		return ui.ToUserUUID
+	}
+
+	return ui.FromUserUUID
+}
+
 func addInterest(ctx echo.Context) error {
 	u, err := verifySession(ctx)
 	if err != nil {
@@ -110,30 +265,108 @@ func addInterest(ctx echo.Context) error {
 		return ctx.JSON(http.StatusBadRequest, err.Error())
 	}
 
+	if req.ToUserUUID == u.UUID {
+		return ctx.JSON(http.StatusBadRequest, gettext("You cannot send an interest to yourself", ctx))
+	}
+
+	if db.Where("uuid = ?", req.ToUserUUID).First(&User{}).RecordNotFound() || isBlocked(u.UUID, req.ToUserUUID) {
+		return ctx.JSON(http.StatusNotFound, gettext("User not found", ctx))
+	}
+
 	var ui UserInterest
 
 	log.Println(req)
 	db.Where("from_user_uuid = ? AND to_user_uuid = ?", req.FromUserUUID, req.ToUserUUID).First(&ui)
-	ui.Type = req.Type
 	ui.FromUserUUID = req.FromUserUUID
 	ui.ToUserUUID = req.ToUserUUID
-	err = db.Save(&ui).Error
 
+	// Older clients post visits here; they are recorded as profile views
+	if strings.ToLower(req.Type) == "visited" {
+		recordProfileView(u, req.ToUserUUID)
+
+		return ctx.NoContent(http.StatusCreated)
+	}
+
+	// Sending an interest back to someone who is waiting on us is an acceptance
+	var reverse UserInterest
+	if !db.Where("from_user_uuid = ? AND to_user_uuid = ? AND status = ?", req.ToUserUUID, req.FromUserUUID, InterestSent).First(&reverse).RecordNotFound() {
+		err = reverse.transition(ctx, InterestAccepted)
+		if err != nil {
+			return ctx.JSON(http.StatusConflict, err.Error())
+		}
+
+		return ctx.JSON(http.StatusOK, reverse)
+	}
+
+	err = ui.transition(ctx, InterestSent)
 	if err != nil {
-		return ctx.JSON(http.StatusInternalServerError, err)
+		return ctx.JSON(http.StatusConflict, err.Error())
 	}
 
-	n := Notification{
-		SenderID:   ui.FromUserUUID,
-		ReceiverID: ui.ToUserUUID,
+	return ctx.JSON(http.StatusCreated, ui)
+}
+
+func respondInterest(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
 	}
 
-	if strings.ToLower(ui.Type) == "visited" {
-		n.ReferenceID = PersonVisited
-	} else if strings.ToLower(ui.Type) == "interested" {
-		n.ReferenceID = PersonInterested
+	var ui UserInterest
+
+	other := ctx.Param("uuid")
+	action := ctx.Param("action")
+
+	switch action {
+	case "accept", "decline":
+		if db.Where("from_user_uuid = ? AND to_user_uuid = ?", other, u.UUID).First(&ui).RecordNotFound() {
+			return ctx.NoContent(http.StatusNotFound)
+		}
+	case "withdraw":
+		if db.Where("from_user_uuid = ? AND to_user_uuid = ?", u.UUID, other).First(&ui).RecordNotFound() {
+			return ctx.NoContent(http.StatusNotFound)
+		}
+	default:
+		return ctx.JSON(http.StatusBadRequest, gettext("Invalid request", ctx))
+	}
+
+	if action == "accept" && isBlocked(u.UUID, other) {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	to := map[string]string{
+		"accept":   InterestAccepted,
+		"decline":  InterestDeclined,
+		"withdraw": InterestWithdrawn,
+	}[action]
+
+	err = ui.transition(ctx, to)
+	if err != nil {
+		return ctx.JSON(http.StatusConflict, err.Error())
 	}
 
-	//n.createAndSend()
-	return ctx.NoContent(http.StatusCreated)
+	return ctx.JSON(http.StatusOK, ui)
+}
+
+// expireInterests moves interests that were not answered within the expiry
+// window to the expired state.
+func expireInterests() {
+	var uu []UserInterest
+
+	db.Where("status = ? AND sent_at < ?", InterestSent, time.Now().Add(-getInterestExpiry())).Find(&uu)
+
+	for i := range uu {
+		err := uu[i].transition(nil, InterestExpired)
+		if err != nil {
+			log.Println("Error while expiring interest: ", err.Error())
+		}
+	}
+
+	log.Printf("Expired %d interests", len(uu))
+}
+
+// migrateInterestStatuses moves interests created before statuses existed
+// into the sent state.
+func migrateInterestStatuses() {
+	db.Exec("UPDATE user_interests SET status = ?, sent_at = created_at WHERE COALESCE(status, '') = '' AND LOWER(type) = 'interested'", InterestSent)
 }
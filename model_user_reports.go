@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const (
+	ReportOpen      = "open"
+	ReportInReview  = "in_review"
+	ReportActioned  = "actioned"
+	ReportDismissed = "dismissed"
+)
+
+const (
+	ModerationWarn    = "warn"
+	ModerationSuspend = "suspend"
+	ModerationBan     = "ban"
+	ModerationDismiss = "dismiss"
+)
+
+type UserReport struct {
+	Model
+
+	ReporterUUID string         `gorm:"type:uuid;index" json:"reporter_uuid"`
+	ReportedUUID string         `gorm:"type:uuid;index" json:"reported_uuid"`
+	Reason       string         `json:"reason"`
+	Details      string         `json:"details"`
+	Evidence     pq.StringArray `gorm:"type:text[]" json:"evidence"`
+
+	Status        string       `gorm:"index" json:"status"`
+	Action        string       `json:"action"`
+	ModeratorNote string       `json:"moderator_note,omitempty"`
+	ResolvedAt    sql.NullTime `json:"resolved_at"`
+}
+
+func getReportReasons() ListItems {
+	return createList(
+		[]string{"Fake profile", "fake_profile"},
+		[]string{"Harassment", "harassment"},
+		[]string{"Inappropriate photos", "inappropriate_photos"},
+		[]string{"Spam or advertising", "spam"},
+		[]string{"Scam or asking for money", "scam"},
+		[]string{"Already married", "already_married"},
+		[]string{"Underage", "underage"},
+		[]string{"Other", "other"},
+	)
+}
+
+func getReportStatuses() []string {
+	return []string{ReportOpen, ReportInReview, ReportActioned, ReportDismissed}
+}
+
+func getModerationActions() []string {
+	return []string{ModerationWarn, ModerationSuspend, ModerationBan, ModerationDismiss}
+}
+
+func (r *UserReport) sanitize(ctx echo.Context) {
+	r.Details = sanitizeText(r.Details, 2000)
+
+	ev := make(pq.StringArray, 0, len(r.Evidence))
+	for _, e := range r.Evidence {
+		e = sanitizeText(e, 500)
+		if e != "" {
+			ev = append(ev, e)
+		}
+	}
+
+	if len(ev) > 10 {
+		ev = ev[:10]
+	}
+
+	r.Evidence = ev
+}
+
+func (r *UserReport) validate(ctx echo.Context) error {
+	if r.ReportedUUID == "" {
+		return errors.New(gettext("User UUID is required", ctx))
+	}
+
+	if r.ReportedUUID == r.ReporterUUID {
+		return errors.New(gettext("You cannot report yourself", ctx))
+	}
+
+	if !getReportReasons().Contains(r.Reason) {
+		return errors.New(gettext("Reason is invalid", ctx))
+	}
+
+	if r.Reason == "other" && r.Details == "" {
+		return errors.New(gettext("Please describe the problem", ctx))
+	}
+
+	if db.Where("uuid = ?", r.ReportedUUID).First(&User{}).RecordNotFound() {
+		return errors.New(gettext("User not found", ctx))
+	}
+
+	return nil
+}
+
+func reportUser(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var r UserReport
+
+	// Populate object from JSON
+	err = ctx.Bind(&r)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	r.zeroID()
+	r.ReporterUUID = u.UUID
+	r.Status = ReportOpen
+	r.Action = ""
+	r.ModeratorNote = ""
+	r.ResolvedAt.Valid = false
+
+	r.sanitize(ctx)
+	err = r.validate(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, err.Error())
+	}
+
+	err = db.Create(&r).Error
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to save report", ctx))
+	}
+
+	return ctx.JSON(http.StatusCreated, r)
+}
+
+// myReports lets a reporter follow what happened to their reports.
+func myReports(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	var rr []UserReport
+
+	db.Where("reporter_uuid = ?", u.UUID).Order("id DESC").Find(&rr)
+
+	for i := range rr {
+		rr[i].ModeratorNote = ""
+	}
+
+	return ctx.JSON(http.StatusOK, rr)
+}
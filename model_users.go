@@ -26,12 +26,15 @@ type User struct {
 	Gender           string `gorm:"index" json:"gender"`
 	MaritalStatus    string `gorm:"index" json:"marital_status"`
 	DOB              string `gorm:"index" json:"date_of_birth"`
-	Caste            string `json:"caste"`
+	Caste            string `gorm:"index" json:"caste"`
 	SubCaste         string `gorm:"index" json:"sub_caste"`
 	AnnualIncome     uint   `gorm:"index" json:"annual_income"`
 	ProfileCreatedBy string `json:"profile_created_by"`
 
 	UserData
+	Attributes
+
+	PartnerPreferences SearchQuery `gorm:"type:jsonb" json:"partner_preferences"`
 
 	Password     string `gorm:"-" json:"password,omitempty"`
 	PasswordHash string `json:"-"`
@@ -58,7 +61,13 @@ type User struct {
 	IsVerified       bool   `json:"is_verified"`
 	VerificationHash string `json:"-"`
 
+	PrivacySettings PrivacySettings `gorm:"type:jsonb" json:"privacy_settings"`
+
+	SuspendedUntil sql.NullTime `json:"suspended_until"`
+	BannedAt       sql.NullTime `json:"banned_at"`
+
 	UserMedia       []Media       `gorm:"-" json:"user_media"`
+	Badges          []string      `gorm:"-" json:"badges"`
 	UserWallet      []Wallet      `gorm:"-" json:"user_wallet"`
 	InterestDetails *UserInterest `gorm:"-" json:"interest_details"`
 }
@@ -71,9 +80,24 @@ func (u *User) sanitize(ctx echo.Context) {
 	u.Phone = sanitizeText(u.Phone, 12)
 
 	u.UserData.sanitize(ctx)
+	u.keepPartnerPreferences()
+	u.PrivacySettings.applyDefaults()
 	u.Language = getLanguageFromContext(ctx)
 }
 
+// keepPartnerPreferences puts back the stored preferences on a profile being
+// saved. They are validated and changed only by savePartnerPreferences, so
+// preferences saved before a list changed do not block other profile edits.
+func (u *User) keepPartnerPreferences() {
+	var stored User
+
+	if u.ID != 0 {
+		db.Select("partner_preferences").Where("id = ?", u.ID).First(&stored)
+	}
+
+	u.PartnerPreferences = stored.PartnerPreferences
+}
+
 func (u *User) validate(ctx echo.Context, skipRequiredCheck bool) error {
 
 	if u.FirstName == "" && !skipRequiredCheck {
@@ -101,6 +125,21 @@ func (u *User) validate(ctx echo.Context, skipRequiredCheck bool) error {
 		return err
 	}
 
+	err = u.normalizeMasterFields(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = u.Attributes.validate(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = u.PrivacySettings.validate(ctx)
+	if err != nil {
+		return err
+	}
+
 	if len(u.Email) == 0 {
 		if !skipRequiredCheck {
 			return errors.New(gettext("An email address is required", ctx))
@@ -159,14 +198,17 @@ func (u *User) getExistsMessage(ctx echo.Context) string {
 	return gettext("A user account was created for you when you subscribed to our newsletter. Reset your password to log in.", ctx)
 }
 
-func (u *User) doSearch(params SearchQuery) (interface{}, error) {
+// doSearch returns the members matching params as cards seen by the viewer.
+func (u *User) doSearch(viewer User, params SearchQuery) (interface{}, error) {
 	var uu []User
 
 	dbQuery := db
 
-	dbQuery = u.query(dbQuery, params)
+	dbQuery = u.query(viewer, dbQuery, params)
 	params.setDefault()
 
+	// Members whose plan boosts visibility are listed first
+	dbQuery = dbQuery.Order("(SELECT COALESCE(MAX(plans.visibility_boost), 0) FROM subscriptions JOIN plans ON plans.id = subscriptions.plan_id WHERE subscriptions.user_uuid = users.uuid AND subscriptions.status = 'active' AND subscriptions.starts_at <= NOW() AND subscriptions.ends_at > NOW()) DESC")
 	dbQuery = dbQuery.Order(params.OrderBy + " " + params.Order)
 
 	dbQuery = dbQuery.Limit(params.Limit)
@@ -174,21 +216,11 @@ func (u *User) doSearch(params SearchQuery) (interface{}, error) {
 	dbQuery = dbQuery.Offset(params.Limit * (int(params.Page) - 1))
 
 	err := dbQuery.Find(&uu).Error
-
-	for i, u := range uu {
-		var ui UserInterest
-		db.Model(&Media{}).Where("user_uuid = ?", u.UUID).Find(&u.UserMedia)
-		db.Model(&Wallet{}).Where("to_user_uuid = ? AND from_user_uuid = ? ", u.UUID, LoggedInUser.UUID).Find(&ui)
-		db.Table("user_interests").Where("to_user_uuid = ? AND from_user_uuid = ? ", u.UUID, LoggedInUser.UUID).Find(&ui)
-
-		// if ui.ID > 0 {
-		u.InterestDetails = &ui
-		// }
-
-		uu[i] = u
+	if err != nil {
+		return nil, err
 	}
 
-	return uu, err
+	return loadProfileCards(viewer.UUID, uu), nil
 }
 
 func (u *User) restore(ctx echo.Context, tx *gorm.DB) error {
@@ -205,22 +237,32 @@ func (u *User) restore(ctx echo.Context, tx *gorm.DB) error {
 	return nil
 }
 
-func (u *User) bulkRead(uuids []string) (interface{}, error) {
+func (u *User) bulkRead(viewer User, uuids []string) (interface{}, error) {
 	var (
 		uu []User
 	)
 
-	db.Where("uuid IN(?)", uuids).Find(&uu)
+	excludeBlocked(db, viewer.UUID, "uuid").Where("uuid IN(?)", uuids).Find(&uu)
+
+	return loadProfileCards(viewer.UUID, uu), nil
+}
+
+func (u *User) project(viewer User) interface{} {
+	if viewer.UUID == u.UUID {
+		return u
+	}
 
-	return uu, nil
+	return getProfileCard(viewer.UUID, *u)
 }
 
 func (u *User) AfterFind() error {
+	u.setLegacyEducationalInfo()
 
 	return nil
 }
 
 func (u *User) AfterSave(tx *gorm.DB) error {
+	u.setLegacyEducationalInfo()
 
 	return nil
 }
@@ -301,12 +343,10 @@ func (u User) getKnownIPs() []string {
 	return ss
 }
 
+// verify records that the member opened the link sent to their email
+// address. is_verified is left to a reviewed ID document.
 func (u *User) verify() {
-	if u.IsVerified {
-		return
-	}
-
-	db.Model(&u).Updates(map[string]interface{}{"is_verified": true})
+	grantBadge(u.UUID, BadgeEmail, 0, "")
 }
 
 func (u *User) getName() string {
@@ -315,8 +355,22 @@ func (u *User) getName() string {
 	return n
 }
 
+// checkStanding returns an error when moderation has suspended or banned the
+// account.
+func (u *User) checkStanding(ctx echo.Context) error {
+	if u.BannedAt.Valid {
+		return errors.New(gettext("Your account has been banned", ctx))
+	}
+
+	if u.SuspendedUntil.Valid && u.SuspendedUntil.Time.After(time.Now()) {
+		return fmt.Errorf(gettext("Your account is suspended until %s", ctx), u.SuspendedUntil.Time.Format("2006-01-02"))
+	}
+
+	return nil
+}
+
 func (u *User) hasVerifiedEmail() bool {
-	return u.IsVerified
+	return hasBadge(u.UUID, BadgeEmail)
 }
 
 func (u User) Count(ctx echo.Context) error {
@@ -331,8 +385,6 @@ func (u User) Count(ctx echo.Context) error {
 	u, err := verifySession(ctx)
 	if err != nil {
 		return ctx.JSON(http.StatusUnauthorized, err.Error())
-	} else {
-		LoggedInUser = u
 	}
 
 	// Populate object from JSON
@@ -342,7 +394,7 @@ func (u User) Count(ctx echo.Context) error {
 	}
 
 	dbQuery := db.Model(&User{})
-	dbQuery = u.query(dbQuery, params)
+	dbQuery = u.query(u, dbQuery, params)
 
 	err = dbQuery.Select("COUNT(id) count").Scan(&resp).Error
 
@@ -353,9 +405,15 @@ func (u User) Count(ctx echo.Context) error {
 	return ctx.JSON(http.StatusOK, resp)
 }
 
-func (u User) query(dbQuery *gorm.DB, params SearchQuery) *gorm.DB {
+// query filters members by params, leaving out the viewer, members in bad
+// standing and anyone either side has blocked.
+func (u User) query(viewer User, dbQuery *gorm.DB, params SearchQuery) *gorm.DB {
+
+	params.resolveMasterFilters()
 
-	dbQuery = dbQuery.Where("uuid != ?", LoggedInUser.UUID)
+	dbQuery = dbQuery.Where("uuid != ?", viewer.UUID)
+	dbQuery = dbQuery.Where("banned_at IS NULL AND (suspended_until IS NULL OR suspended_until < NOW())")
+	dbQuery = excludeBlocked(dbQuery, viewer.UUID, "uuid")
 
 	if params.FromAge > 18 {
 		dbQuery = dbQuery.Where("DATE_PART('Year', NOW()) - DATE_PART('Year', dob::date) >= ?", params.FromAge)
@@ -393,6 +451,70 @@ func (u User) query(dbQuery *gorm.DB, params SearchQuery) *gorm.DB {
 		dbQuery = dbQuery.Where("educational_info->>'education' IN (?)", params.Educations)
 	}
 
+	if len(params.Degrees) > 0 {
+		dbQuery = dbQuery.Where("EXISTS (SELECT 1 FROM jsonb_array_elements(CASE WHEN jsonb_typeof(educational_info->'degrees') = 'array' THEN educational_info->'degrees' ELSE '[]' END) d WHERE d->>'name' IN (?))", params.Degrees)
+	}
+
+	if len(params.Professions) > 0 {
+		dbQuery = dbQuery.Where("career_info->>'profession' IN (?)", params.Professions)
+	}
+
+	if len(params.ProfessionCategories) > 0 {
+		dbQuery = dbQuery.Where("career_info->>'profession_category' IN (?)", params.ProfessionCategories)
+	}
+
+	if len(params.EmploymentTypes) > 0 {
+		dbQuery = dbQuery.Where("career_info->>'employment_type' IN (?)", params.EmploymentTypes)
+	}
+
+	if len(params.Employers) > 0 {
+		dbQuery = dbQuery.Where("career_info->>'employer' IN (?)", params.Employers)
+	}
+
+	if len(params.FamilyTypes) > 0 {
+		dbQuery = dbQuery.Where("family_info->>'family_type' IN (?)", params.FamilyTypes)
+	}
+
+	if len(params.NativePlaces) > 0 {
+		dbQuery = dbQuery.Where("family_info->>'native_place' IN (?)", params.NativePlaces)
+	}
+
+	if params.HeightFrom > 0 {
+		dbQuery = dbQuery.Where("height_cm >= ?", params.HeightFrom)
+	}
+
+	if params.HeightTo > 0 {
+		dbQuery = dbQuery.Where("height_cm <= ?", params.HeightTo)
+	}
+
+	if len(params.Complexions) > 0 {
+		dbQuery = dbQuery.Where("complexion IN (?)", params.Complexions)
+	}
+
+	if len(params.Diets) > 0 {
+		dbQuery = dbQuery.Where("diet IN (?)", params.Diets)
+	}
+
+	if len(params.Smoking) > 0 {
+		dbQuery = dbQuery.Where("smoking IN (?)", params.Smoking)
+	}
+
+	if len(params.Drinking) > 0 {
+		dbQuery = dbQuery.Where("drinking IN (?)", params.Drinking)
+	}
+
+	if len(params.MotherTongues) > 0 {
+		dbQuery = dbQuery.Where("mother_tongue IN (?)", params.MotherTongues)
+	}
+
+	if len(params.Religions) > 0 {
+		dbQuery = dbQuery.Where("religion IN (?)", params.Religions)
+	}
+
+	if len(params.Disabilities) > 0 {
+		dbQuery = dbQuery.Where("disability IN (?)", params.Disabilities)
+	}
+
 	if len(params.Cities) > 0 {
 		dbQuery = dbQuery.Where("city IN (?)", params.Cities)
 	}
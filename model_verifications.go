@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	uuid "github.com/satori/go.uuid"
+)
+
+const (
+	VerificationPending  = "pending"
+	VerificationApproved = "approved"
+	VerificationRejected = "rejected"
+)
+
+const (
+	VerificationKindID = "id"
+)
+
+const (
+	DocumentAadhaar  = "aadhaar"
+	DocumentPAN      = "pan"
+	DocumentPassport = "passport"
+)
+
+var errVerificationReviewed = errors.New("Verification has already been reviewed")
+
+// Aadhaar is only taken masked: the last four digits, optionally after the
+// eight Xs of a masked e-Aadhaar.
+var documentNumberRegexps = map[string]*regexp.Regexp{
+	DocumentAadhaar:  regexp.MustCompile(`^(X{8})?[0-9]{4}$`),
+	DocumentPAN:      regexp.MustCompile(`^[A-Z]{5}[0-9]{4}[A-Z]$`),
+	DocumentPassport: regexp.MustCompile(`^[A-Z][0-9]{7}$`),
+}
+
+// Verification is a member's request to prove who they are. The document is
+// kept in private storage under Path until it is purged after review; only
+// the masked document number is kept for good.
+type Verification struct {
+	Model
+
+	UserUUID        string       `gorm:"type:uuid;index" json:"-"`
+	Kind            string       `gorm:"index" json:"kind"`
+	DocumentType    string       `json:"document_type"`
+	DocumentNumber  string       `json:"document_number"` // masked
+	Path            string       `json:"-"`
+	Status          string       `gorm:"index" json:"status"`
+	RejectionReason string       `json:"rejection_reason"`
+	ReviewedBy      string       `json:"-"`
+	ReviewedAt      sql.NullTime `json:"reviewed_at"`
+	PurgedAt        sql.NullTime `json:"-"`
+
+	// Selfie verifications only
+	Gesture            string          `json:"gesture,omitempty"`
+	ChallengeExpiresAt sql.NullTime    `json:"challenge_expires_at"`
+	MediaID            uint            `json:"-"` // photo the selfie is compared with
+	MediaPath          string          `json:"-"` // and its content when the selfie was taken
+	FaceScore          sql.NullFloat64 `json:"face_score"`
+}
+
+func getDocumentTypes() []string {
+	return []string{DocumentAadhaar, DocumentPAN, DocumentPassport}
+}
+
+func getVerificationRetentionDays() int {
+	days, err := strconv.Atoi(os.Getenv("VM_VERIFICATION_RETENTION_DAYS"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+
+	return days
+}
+
+// maskDocumentNumber keeps the last four characters. Aadhaar numbers, which
+// arrive as their last four digits, are padded to the masked e-Aadhaar form.
+func maskDocumentNumber(documentType string, n string) string {
+	if documentType == DocumentAadhaar && len(n) == 4 {
+		return strings.Repeat("X", 8) + n
+	}
+
+	if len(n) <= 4 {
+		return n
+	}
+
+	return strings.Repeat("X", len(n)-4) + n[len(n)-4:]
+}
+
+// readVerificationFile reads an uploaded image or PDF. Images are re-encoded
+// to drop their metadata.
+func readVerificationFile(ctx echo.Context, field string) ([]byte, string, string, error) {
+	file, err := ctx.FormFile(field)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if file.Size > getMediaMaxSize() {
+		return nil, "", "", errImageTooLarge
+	}
+
+	src, err := file.Open()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	defer src.Close()
+
+	data, err := ioutil.ReadAll(src)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	if bytes.HasPrefix(data, []byte("%PDF-")) {
+		return data, "application/pdf", ".pdf", nil
+	}
+
+	p, err := processImage(data)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return p.Original, p.ContentType, p.Ext, nil
+}
+
+// storeVerificationFile saves a document under a random key, as documents of
+// different members must never share a file.
+func storeVerificationFile(data []byte, contentType string, ext string) (string, error) {
+	key := "verifications/" + uuid.NewV4().String() + ext
+
+	return key, blobStore.put(key, data, contentType)
+}
+
+func verifications(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	vv := []Verification{}
+
+	db.Where("user_uuid = ?", u.UUID).Order("id DESC").Find(&vv)
+
+	badges := getBadges([]string{u.UUID})[u.UUID]
+	if badges == nil {
+		badges = []string{}
+	}
+
+	return ctx.JSON(http.StatusOK, map[string]interface{}{
+		"badges":        badges,
+		"verifications": vv,
+	})
+}
+
+func submitVerification(ctx echo.Context) error {
+	var count int
+
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	documentType := ctx.FormValue("document_type")
+	number := strings.ToUpper(strings.Replace(strings.TrimSpace(ctx.FormValue("document_number")), " ", "", -1))
+
+	if !isOneOf(documentType, getDocumentTypes()) {
+		return ctx.JSON(http.StatusBadRequest, gettext("Document type is invalid", ctx))
+	}
+
+	if documentType == DocumentAadhaar && !documentNumberRegexps[documentType].MatchString(number) {
+		return ctx.JSON(http.StatusBadRequest, gettext("Enter only the last four digits of your Aadhaar number and upload the masked e-Aadhaar", ctx))
+	}
+
+	if !documentNumberRegexps[documentType].MatchString(number) {
+		return ctx.JSON(http.StatusBadRequest, gettext("Document number is invalid", ctx))
+	}
+
+	db.Model(&UserBadge{}).Where("user_uuid = ? AND type = ?", u.UUID, BadgeID).Count(&count)
+	if count > 0 {
+		return ctx.JSON(http.StatusConflict, gettext("Your identity is already verified", ctx))
+	}
+
+	db.Model(&Verification{}).Where("user_uuid = ? AND kind = ? AND status = ?", u.UUID, VerificationKindID, VerificationPending).Count(&count)
+	if count > 0 {
+		return ctx.JSON(http.StatusConflict, gettext("Your document is already being reviewed", ctx))
+	}
+
+	data, contentType, ext, err := readVerificationFile(ctx, "document")
+	if err != nil {
+		return ctx.JSON(http.StatusBadRequest, gettext("Document must be an image or a PDF", ctx))
+	}
+
+	key, err := storeVerificationFile(data, contentType, ext)
+	if err != nil {
+		log.Println("Error while storing verification document: ", err.Error())
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to upload document", ctx))
+	}
+
+	v := Verification{
+		UserUUID:       u.UUID,
+		Kind:           VerificationKindID,
+		DocumentType:   documentType,
+		DocumentNumber: maskDocumentNumber(documentType, number),
+		Path:           key,
+		Status:         VerificationPending,
+	}
+
+	err = db.Create(&v).Error
+	if err != nil {
+		blobStore.delete(key)
+		return ctx.JSON(http.StatusInternalServerError, gettext("Unable to upload document", ctx))
+	}
+
+	return ctx.JSON(http.StatusCreated, v)
+}
+
+// adminVerificationsHandler lists verifications oldest first. Selfies are
+// listed best match first, with unscored ones last.
+func adminVerificationsHandler(ctx echo.Context) error {
+	type verificationItem struct {
+		Verification
+		User        User   `json:"user"`
+		DocumentURL string `json:"document_url"`
+		Photo       *Media `json:"photo,omitempty"`
+	}
+
+	var vv []Verification
+
+	status := ctx.QueryParam("status")
+	if status == "" {
+		status = VerificationPending
+	}
+
+	page, err := strconv.Atoi(ctx.QueryParam("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	limit := 50
+
+	q := db.Where("status = ?", status)
+	if kind := ctx.QueryParam("kind"); kind != "" {
+		q = q.Where("kind = ?", kind)
+	}
+
+	if ctx.QueryParam("kind") == VerificationKindSelfie {
+		q = q.Order("face_score DESC NULLS LAST")
+	}
+
+	q.Order("id ASC").Limit(limit).Offset(limit * (page - 1)).Find(&vv)
+
+	uuids := make([]string, 0, len(vv))
+	for _, v := range vv {
+		uuids = append(uuids, v.UserUUID)
+	}
+
+	var uu []User
+	db.Unscoped().Where("uuid IN (?)", getUnique(uuids)).Find(&uu)
+
+	users := make(map[string]User, len(uu))
+	for _, u := range uu {
+		users[u.UUID] = u
+	}
+
+	items := make([]verificationItem, 0, len(vv))
+	for _, v := range vv {
+		item := verificationItem{Verification: v, User: users[v.UserUUID]}
+
+		if v.Path != "" {
+			item.DocumentURL, err = blobStore.url(v.Path, getBlobURLTTL())
+			if err != nil {
+				log.Println("Error while signing document URL: ", err.Error())
+			}
+		}
+
+		// The profile photo a selfie has to match
+		if v.MediaID != 0 {
+			var m Media
+
+			if !db.Unscoped().Where("id = ?", v.MediaID).First(&m).RecordNotFound() {
+				item.Photo = &m
+			}
+		}
+
+		items = append(items, item)
+	}
+
+	return ctx.JSON(http.StatusOK, items)
+}
+
+func adminReviewVerificationHandler(ctx echo.Context) error {
+	var (
+		v    Verification
+		data struct {
+			Action string `json:"action"`
+			Reason string `json:"reason"`
+		}
+	)
+
+	err := ctx.Bind(&data)
+	if err != nil {
+		return returnInvalidData(ctx, err)
+	}
+
+	if !isOneOf(data.Action, []string{"approve", "reject"}) {
+		return ctx.JSON(http.StatusBadRequest, "Action is invalid")
+	}
+
+	if data.Action == "reject" && strings.TrimSpace(data.Reason) == "" {
+		return ctx.JSON(http.StatusBadRequest, "Reason is required to reject a verification")
+	}
+
+	if db.Where("uuid = ?", ctx.Param("uuid")).First(&v).RecordNotFound() {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if data.Action == "approve" && v.Kind == VerificationKindSelfie && !isSelfiePhotoCurrent(v) {
+		return ctx.JSON(http.StatusConflict, "The photo this selfie was compared with has changed, reject it instead")
+	}
+
+	err = reviewVerification(&v, data.Action, data.Reason, getAdminActor(ctx))
+	if err == errVerificationReviewed {
+		return ctx.JSON(http.StatusConflict, err.Error())
+	}
+
+	if err != nil {
+		return ctx.JSON(http.StatusInternalServerError, "Unable to review verification")
+	}
+
+	return ctx.JSON(http.StatusOK, v)
+}
+
+// reviewVerification records an admin's decision on a pending verification
+// and tells the member.
+func reviewVerification(v *Verification, action string, reason string, actor string) error {
+	updates := map[string]interface{}{
+		"status":           VerificationApproved,
+		"rejection_reason": "",
+		"reviewed_by":      actor,
+		"reviewed_at":      time.Now(),
+	}
+
+	if action == "reject" {
+		updates["status"] = VerificationRejected
+		updates["rejection_reason"] = sanitizeText(reason, 500)
+	}
+
+	res := db.Model(&Verification{}).Where("id = ? AND status = ?", v.ID, VerificationPending).Updates(updates)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return errVerificationReviewed
+	}
+
+	n := Notification{ReceiverID: v.UserUUID, ReferenceID: VerificationDeclined}
+
+	if action == "approve" {
+		n.ReferenceID = BadgeGranted
+
+		approveVerification(*v, actor)
+	}
+
+	go n.createAndSend()
+
+	db.Where("id = ?", v.ID).First(v)
+
+	return nil
+}
+
+// approveVerification grants the badge the verification proves.
+func approveVerification(v Verification, actor string) {
+	switch v.Kind {
+	case VerificationKindID:
+		grantBadge(v.UserUUID, BadgeID, v.ID, actor)
+
+		db.Exec("UPDATE users SET is_verified = ? WHERE uuid = ?", true, v.UserUUID)
+
+		go rewardReferral(v.UserUUID)
+	case VerificationKindSelfie:
+		grantBadge(v.UserUUID, BadgePhoto, v.ID, actor)
+
+		// The photo may have been swapped while the badge was being granted
+		if !isSelfiePhotoCurrent(v) {
+			revokeBadge(v.UserUUID, BadgePhoto)
+		}
+	}
+}
+
+// purgeVerificationDocuments deletes documents once they have been reviewed
+// and the retention period is over.
+func purgeVerificationDocuments() {
+	var vv []Verification
+
+	before := time.Now().AddDate(0, 0, -getVerificationRetentionDays())
+
+	db.Where("path <> '' AND status <> ? AND reviewed_at < ?", VerificationPending, before).Find(&vv)
+
+	for _, v := range vv {
+		err := blobStore.delete(v.Path)
+		if err != nil {
+			log.Println("Error while purging verification document: ", err.Error())
+			continue
+		}
+
+		db.Model(&Verification{}).Where("id = ?", v.ID).Updates(map[string]interface{}{"path": "", "purged_at": time.Now()})
+	}
+}
@@ -44,6 +44,29 @@ func startServer() {
 	e.POST("/api/admin/users/verify", userVerifyHandler, httpAuth)
 	e.POST("/api/admin/users/unverify", userUnverifyHandler, httpAuth)   // Open endpoint
 	e.PATCH("/api/admin/users/update", userAdminUpdateHandler, httpAuth) // Open endpoint
+	e.GET("/api/admin/reports", adminReportsHandler, httpAuth)
+	e.POST("/api/admin/reports/:uuid/triage", adminTriageReportHandler, httpAuth)
+	e.POST("/api/admin/reports/:uuid/action", adminModerateReportHandler, httpAuth) // action (warn|suspend|ban|dismiss)
+	e.GET("/api/admin/messages/flagged", adminFlaggedMessagesHandler, httpAuth)
+	e.GET("/api/admin/media", adminMediaHandler, httpAuth)                                    // filter by status, pending by default
+	e.POST("/api/admin/media/review", adminReviewMediaHandler, httpAuth)                      // bulk action (approve|reject)
+	e.GET("/api/admin/verifications", adminVerificationsHandler, httpAuth)                    // filter by status, kind
+	e.POST("/api/admin/verifications/:uuid/review", adminReviewVerificationHandler, httpAuth) // action (approve|reject)
+	e.POST("/api/admin/messages/:uuid/review", adminReviewMessageHandler, httpAuth)           // action (clear|remove)
+	e.GET("/api/admin/plans", adminPlansHandler, httpAuth)
+	e.POST("/api/admin/plans", adminCreatePlanHandler, httpAuth)
+	e.PATCH("/api/admin/plans/:uuid", adminUpdatePlanHandler, httpAuth)
+	e.GET("/api/admin/payments", adminPaymentsHandler, httpAuth) // filter by user_uuid, transaction_id, from, to
+	e.POST("/api/admin/payments/:transaction_id/refund", adminRefundPaymentHandler, httpAuth)
+	e.POST("/api/admin/users/:uuid/credits", adminCreditWalletHandler, httpAuth) // goodwill credit
+	e.GET("/api/admin/audit", adminAuditLogsHandler, httpAuth)
+	e.GET("/api/admin/coupons", adminCouponsHandler, httpAuth)
+	e.POST("/api/admin/coupons", adminCreateCouponHandler, httpAuth)
+	e.PATCH("/api/admin/coupons/:uuid", adminUpdateCouponHandler, httpAuth)
+	e.GET("/api/admin/master-data", adminMasterDataHandler, httpAuth) // kind (religion|caste|sub_caste|education|profession)
+	e.POST("/api/admin/master-data", adminCreateMasterItemHandler, httpAuth)
+	e.PATCH("/api/admin/master-data/:uuid", adminUpdateMasterItemHandler, httpAuth)
+	e.POST("/api/admin/master-data/normalize", adminNormalizeMasterDataHandler, httpAuth) // maps free text to codes
 
 	// Users
 	e.POST("/api/users/register", userRegisterHandler)                   // Open endpoint
@@ -60,6 +83,11 @@ func startServer() {
 	e.PUT("/api/users/me", userUpdateHandler, jwtAuth)                        // Open endpoint
 	e.PATCH("/api/users/me", userPatchHandler, jwtAuth)                       // Open endpoint
 	e.POST("/api/users/me/send-verify/:type", userSendVerifyHandler, jwtAuth) // Open endpoint // type (otp|email)
+	e.POST("/api/users/me/verify-phone", confirmOTP, jwtAuth)
+	e.GET("/api/users/me/verifications", verifications, jwtAuth)
+	e.POST("/api/users/me/verifications/selfie", selfieChallenge, jwtAuth)    // returns the gesture to make
+	e.POST("/api/users/me/verifications/:uuid/selfie", submitSelfie, jwtAuth) // multipart: selfie
+	e.POST("/api/users/me/verifications", submitVerification, jwtAuth)        // multipart: document_type, document_number, document (Aadhaar: last 4 digits, masked e-Aadhaar)
 	e.POST("/api/users/me/logout", sessionsLogoutHandler, jwtAuth)            // Open endpoint
 	// e.POST("/users/me/subscriptions", userSubscriptionsHandler) // Open endpoint
 	// e.POST("/users/me/resubscribe", userResubscribeHandler) // Open endpoint
@@ -67,14 +95,55 @@ func startServer() {
 	e.GET("/api/users/me/interests", interests, jwtAuth)
 	e.GET("/api/users/me/interested", interested, jwtAuth)
 	e.POST("/api/users/me/interest", addInterest, jwtAuth)
+	e.POST("/api/users/me/interest/:uuid/:action", respondInterest, jwtAuth) // action (accept|decline|withdraw)
+	e.GET("/api/users/me/matches", matches, jwtAuth)
+	e.GET("/api/users/me/partner-preferences", partnerPreferences, jwtAuth)
+	e.PUT("/api/users/me/partner-preferences", savePartnerPreferences, jwtAuth)
+	e.GET("/api/users/me/recommendations", recommendations, jwtAuth) // search with the partner preferences
+	e.GET("/api/users/me/visitors", visitors, jwtAuth)
+	e.GET("/api/users/me/shortlist", shortlist, jwtAuth)
+	e.POST("/api/users/me/shortlist", addToShortlist, jwtAuth)
+	e.DELETE("/api/users/me/shortlist/:uuid", removeFromShortlist, jwtAuth)
+	e.GET("/api/users/me/unlocks", contactUnlocks, jwtAuth)
+	e.POST("/api/users/me/unlocks", unlockContactHandler, jwtAuth)
+	e.GET("/api/users/me/blocks", blocks, jwtAuth)
+	e.POST("/api/users/me/blocks", blockUser, jwtAuth)
+	e.DELETE("/api/users/me/blocks/:uuid", unblockUser, jwtAuth)
+	e.POST("/api/users/me/reports", reportUser, jwtAuth)
+	e.GET("/api/users/me/reports", myReports, jwtAuth)
+
+	e.GET("/api/users/me/conversations", conversations, jwtAuth)
+	e.POST("/api/users/me/conversations", startConversation, jwtAuth, premiumOnly(PlanFeatureChat)) // replying is free
+	e.GET("/api/users/me/conversations/:uuid/messages", messages, jwtAuth)
+	e.POST("/api/users/me/conversations/:uuid/messages", sendMessage, jwtAuth)
+	e.POST("/api/users/me/conversations/:uuid/read", readConversation, jwtAuth)
+	e.POST("/api/users/me/conversations/:uuid/mute", muteConversation, jwtAuth)
+	e.GET("/api/users/me/ws", realtimeHandler, jwtAuth)            // WebSocket, resume with ?last_event_id=, reload on "resync"
+	e.GET("/api/users/profile/:uuid", userProfileHandler, jwtAuth) // records a profile view
 
 	e.POST("/api/users/media/:type/:uuid", upload, jwtAuth)
-	e.GET("/api/users/media/:uuid", download, jwtAuth)
+	e.GET("/api/users/media/:uuid", download, jwtAuth) // redirects to a signed URL
+	e.GET("/api/media", blobHandler)                   // signed URLs of the local store
+	e.GET("/api/users/me/media", album, jwtAuth)
+	e.PUT("/api/users/me/media/order", reorderMedia, jwtAuth) // uuids in display order
+	e.PATCH("/api/users/me/media/:uuid", updateMedia, jwtAuth)
+	e.DELETE("/api/users/me/media/:uuid", deleteMedia, jwtAuth)
+	e.POST("/api/users/me/media/:uuid/primary", setPrimaryMedia, jwtAuth)
+	e.POST("/api/users/payments/orders", createPaymentOrder, jwtAuth)
 	e.POST("/api/users/payments", savePayments, jwtAuth)
 	e.GET("/api/users/balance", getBalance, jwtAuth)
+	e.GET("/api/users/me/wallet/transactions", walletTransactions, jwtAuth)
+	e.GET("/api/plans", plans, jwtAuth)
+	e.GET("/api/users/me/subscriptions", subscriptions, jwtAuth)
+	e.POST("/api/users/me/subscriptions", buySubscription, jwtAuth) // paid from the wallet
+	e.GET("/api/users/me/referrals", referrals, jwtAuth)
+	e.POST("/api/users/me/coupons/check", checkCouponHandler, jwtAuth)
+	e.GET("/api/users/me/invoices", invoices, jwtAuth)
+	e.GET("/api/users/me/invoices/:uuid", downloadInvoice, jwtAuth) // PDF
 	// e.GET("/users/media/:id", download, jwtAuth)
 
 	e.GET("/api/ping", pingHandler)
+	e.POST("/api/payments/callback", paymentCallbackHandler) // signed by the gateway
 	e.GET("/api/lists", listAPIHandler, jwtAuth)
 
 	e.GET("/*", redirectHandler)
@@ -30,8 +30,11 @@ func main() {
 		log.Fatal(err)
 	}
 
+	paymentGateway = newPaymentGateway()
+	blobStore = newBlobStore()
 	openDatabaseConnection()
 	migrate()
 	setupCron()
+	go listenForEvents()
 	startServer()
 }
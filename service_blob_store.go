@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/labstack/echo"
+)
+
+var errBlobNotFound = errors.New("Blob not found")
+
+// BlobStore keeps uploaded files under opaque keys such as
+// "media/<sha256>.jpg". Nothing in a key comes from the client.
+//
+// Clients never get keys. They get URLs from url, which expire and are only
+// issued once the caller has decided the member may see the file.
+type BlobStore interface {
+	put(key string, data []byte, contentType string) error
+	get(key string) (io.ReadCloser, error)
+	delete(key string) error
+	url(key string, ttl time.Duration) (string, error)
+}
+
+var blobStore BlobStore
+
+// newBlobStore picks the backend from VM_STORAGE_DRIVER: "local" (default),
+// "s3" or "minio". An unknown driver, or a configured remote store whose
+// bucket cannot be reached, stops the server, as falling back to local disk
+// would lose uploads on hosts with ephemeral storage. The local store signs
+// its URLs with VM_MEDIA_URL_SECRET, which must be set.
+func newBlobStore() BlobStore {
+	switch driver := os.Getenv("VM_STORAGE_DRIVER"); driver {
+	case "", "local":
+	case "s3":
+		s, err := newS3Store(os.Getenv("AWS_S3_BUCKET"), &aws.Config{Region: aws.String(os.Getenv("AWS_REGION"))}, true)
+		if err == nil {
+			return s
+		}
+
+		log.Fatal("Unable to use S3 storage: ", err.Error())
+	case "minio":
+		s, err := newS3Store(os.Getenv("VM_MINIO_BUCKET"), &aws.Config{
+			Endpoint:         aws.String(os.Getenv("VM_MINIO_ENDPOINT")),
+			Region:           aws.String("us-east-1"),
+			Credentials:      credentials.NewStaticCredentials(os.Getenv("VM_MINIO_ACCESS_KEY"), os.Getenv("VM_MINIO_SECRET_KEY"), ""),
+			S3ForcePathStyle: aws.Bool(true),
+		}, false)
+		if err == nil {
+			return s
+		}
+
+		log.Fatal("Unable to use MinIO storage: ", err.Error())
+	default:
+		log.Fatal("Unknown storage driver: ", driver)
+	}
+
+	if len(getBlobURLSecret()) == 0 {
+		log.Fatal("VM_MEDIA_URL_SECRET is required to sign media URLs")
+	}
+
+	root := os.Getenv("VM_STORAGE_LOCAL_DIR")
+	if root == "" {
+		root = "storage"
+	}
+
+	return &localStore{root: root}
+}
+
+func getBlobURLTTL() time.Duration {
+	minutes, err := strconv.Atoi(os.Getenv("VM_MEDIA_URL_TTL"))
+	if err != nil || minutes <= 0 {
+		minutes = 60
+	}
+
+	return time.Duration(minutes) * time.Minute
+}
+
+func getBlobURLSecret() []byte {
+	return []byte(os.Getenv("VM_MEDIA_URL_SECRET"))
+}
+
+func signBlobKey(key string, expires int64) string {
+	mac := hmac.New(sha256.New, getBlobURLSecret())
+	mac.Write([]byte(key + "\n" + strconv.FormatInt(expires, 10)))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func isValidBlobKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return false
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+	}
+
+	return true
+}
+
+// localStore keeps blobs on disk. The directory must not be inside public/,
+// which is served as is.
+type localStore struct {
+	root string
+}
+
+func (s *localStore) path(key string) (string, error) {
+	if !isValidBlobKey(key) {
+		return "", errors.New("Invalid blob key")
+	}
+
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *localStore) put(key string, data []byte, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0750)
+	if err != nil {
+		return err
+	}
+
+	// Write then rename so readers never see a partial file
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *localStore) get(key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(p)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+
+	return f, err
+}
+
+// url signs a link to blobHandler. The expiry is rounded up to windows of
+// half the TTL so a file keeps the same URL for a while and browsers can
+// cache it; a link stays valid for between half and all of the TTL.
+func (s *localStore) url(key string, ttl time.Duration) (string, error) {
+	if !isValidBlobKey(key) {
+		return "", errors.New("Invalid blob key")
+	}
+
+	window := int64(ttl / time.Second / 2)
+	if window < 1 {
+		window = 1
+	}
+
+	expires := (time.Now().Unix()/window + 2) * window
+
+	q := url.Values{}
+	q.Set("key", key)
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("signature", signBlobKey(key, expires))
+
+	return os.Getenv("VM_API_URL") + "/api/media?" + q.Encode(), nil
+}
+
+func (s *localStore) delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// s3Store keeps blobs in a private bucket on S3 or an S3-compatible server.
+type s3Store struct {
+	client  *s3.S3
+	bucket  string
+	encrypt bool
+}
+
+// newS3Store connects to a bucket. Server-side encryption is only requested
+// from AWS, as MinIO needs a KMS for it.
+func newS3Store(bucket string, config *aws.Config, encrypt bool) (*s3Store, error) {
+	if bucket == "" {
+		return nil, errors.New("Bucket is not configured")
+	}
+
+	s, err := session.NewSession(config)
+	if err != nil {
+		return nil, err
+	}
+
+	client := s3.New(s)
+
+	// Fails on bad credentials or endpoints as well as a missing bucket
+	_, err = client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3Store{client: client, bucket: bucket, encrypt: encrypt}, nil
+}
+
+func (s *s3Store) put(key string, data []byte, contentType string) error {
+	if !isValidBlobKey(key) {
+		return errors.New("Invalid blob key")
+	}
+
+	in := &s3.PutObjectInput{
+		Bucket:        aws.String(s.bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(data),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentType:   aws.String(contentType),
+	}
+
+	if s.encrypt {
+		in.ServerSideEncryption = aws.String("AES256")
+	}
+
+	_, err := s.client.PutObject(in)
+
+	return err
+}
+
+func (s *s3Store) get(key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			return nil, errBlobNotFound
+		}
+
+		return nil, err
+	}
+
+	return out.Body, nil
+}
+
+func (s *s3Store) url(key string, ttl time.Duration) (string, error) {
+	req, _ := s.client.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	return req.Presign(ttl)
+}
+
+func (s *s3Store) delete(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+
+	return err
+}
+
+// blobHandler serves files of the local store to holders of a signed URL. No
+// session is needed: access was checked when the URL was issued.
+func blobHandler(ctx echo.Context) error {
+	key := ctx.QueryParam("key")
+
+	expires, err := strconv.ParseInt(ctx.QueryParam("expires"), 10, 64)
+	if err != nil || !isValidBlobKey(key) || len(getBlobURLSecret()) == 0 {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if !hmac.Equal([]byte(signBlobKey(key, expires)), []byte(ctx.QueryParam("signature"))) {
+		return ctx.NoContent(http.StatusForbidden)
+	}
+
+	ttl := expires - time.Now().Unix()
+	if ttl <= 0 {
+		return ctx.NoContent(http.StatusGone)
+	}
+
+	r, err := blobStore.get(key)
+	if err == errBlobNotFound {
+		return ctx.NoContent(http.StatusNotFound)
+	}
+
+	if err != nil {
+		log.Println("Error while reading blob: ", err.Error())
+		return ctx.NoContent(http.StatusInternalServerError)
+	}
+
+	defer r.Close()
+
+	ctx.Response().Header().Set("Cache-Control", "private, max-age="+strconv.FormatInt(ttl, 10))
+
+	return ctx.Stream(http.StatusOK, getMediaContentType(key), r)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo"
+)
+
+func TestIsValidBlobKey(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"media/ab/cd.jpg", true},
+		{"photo.webp", true},
+		{"", false},
+		{"/etc/passwd", false},
+		{"media/../../etc/passwd", false},
+		{"media/./a.jpg", false},
+		{"media//a.jpg", false},
+		{"media/", false},
+		{`media\..\a.jpg`, false},
+	}
+
+	for _, tt := range tests {
+		if got := isValidBlobKey(tt.key); got != tt.want {
+			t.Errorf("isValidBlobKey(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestSignBlobKey(t *testing.T) {
+	setTestEnv(t, "VM_MEDIA_URL_SECRET", "test-secret")
+
+	s := signBlobKey("media/a.jpg", 1000)
+
+	if s != signBlobKey("media/a.jpg", 1000) {
+		t.Error("signature is not stable")
+	}
+
+	if s == signBlobKey("media/b.jpg", 1000) || s == signBlobKey("media/a.jpg", 1001) {
+		t.Error("signature does not cover the key and expiry")
+	}
+
+	// The key and expiry are joined with a separator, so they cannot be shifted
+	if signBlobKey("media/a1", 23) == signBlobKey("media/a", 123) {
+		t.Error("signature of a shifted key and expiry matches")
+	}
+
+	setTestEnv(t, "VM_MEDIA_URL_SECRET", "other-secret")
+
+	if s == signBlobKey("media/a.jpg", 1000) {
+		t.Error("signature does not depend on the secret")
+	}
+}
+
+func TestLocalStoreURLExpiry(t *testing.T) {
+	setTestEnv(t, "VM_MEDIA_URL_SECRET", "test-secret")
+
+	s := &localStore{}
+
+	for _, ttl := range []time.Duration{time.Minute, time.Hour, 24 * time.Hour} {
+		before := time.Now().Unix()
+
+		raw, err := s.url("media/a.jpg", ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		after := time.Now().Unix()
+
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expires, err := strconv.ParseInt(u.Query().Get("expires"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Valid for between half and all of the TTL from when it was signed
+		if left := time.Duration(expires-before) * time.Second; left < ttl/2 {
+			t.Errorf("TTL %s: URL is valid for only %s", ttl, left)
+		}
+
+		if left := time.Duration(expires-after) * time.Second; left > ttl {
+			t.Errorf("TTL %s: URL is valid for %s", ttl, left)
+		}
+
+		if u.Query().Get("signature") != signBlobKey("media/a.jpg", expires) {
+			t.Errorf("TTL %s: URL is not signed", ttl)
+		}
+	}
+
+	if _, err := s.url("../a.jpg", time.Hour); err == nil {
+		t.Error("signed a URL for an invalid key")
+	}
+}
+
+func TestBlobHandler(t *testing.T) {
+	setTestEnv(t, "VM_MEDIA_URL_SECRET", "test-secret")
+
+	root, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(root)
+
+	old := blobStore
+	blobStore = &localStore{root: root}
+	defer func() { blobStore = old }()
+
+	err = blobStore.put("media/a.jpg", []byte("image"), "image/jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	tests := []struct {
+		name      string
+		key       string
+		expires   int64
+		signature string
+		want      int
+	}{
+		{"signed", "media/a.jpg", future, signBlobKey("media/a.jpg", future), http.StatusOK},
+		{"forged", "media/a.jpg", future, "forged", http.StatusForbidden},
+		{"signed for another file", "media/a.jpg", future, signBlobKey("media/b.jpg", future), http.StatusForbidden},
+		{"expired", "media/a.jpg", past, signBlobKey("media/a.jpg", past), http.StatusGone},
+		{"missing", "media/b.jpg", future, signBlobKey("media/b.jpg", future), http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		q := url.Values{}
+		q.Set("key", tt.key)
+		q.Set("expires", strconv.FormatInt(tt.expires, 10))
+		q.Set("signature", tt.signature)
+
+		req := httptest.NewRequest(http.MethodGet, "/api/media?"+q.Encode(), nil)
+		rec := httptest.NewRecorder()
+
+		err := blobHandler(echo.New().NewContext(req, rec))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if rec.Code != tt.want {
+			t.Errorf("%s: got status %d, want %d", tt.name, rec.Code, tt.want)
+		}
+	}
+
+	// Without a secret nothing is served, as anyone could sign with an empty key
+	setTestEnv(t, "VM_MEDIA_URL_SECRET", "")
+
+	req := httptest.NewRequest(http.MethodGet, "/api/media?key=media/a.jpg&expires="+strconv.FormatInt(future, 10)+"&signature="+signBlobKey("media/a.jpg", future), nil)
+	rec := httptest.NewRecorder()
+
+	err = blobHandler(echo.New().NewContext(req, rec))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("without a secret: got status %d, want %d", rec.Code, http.StatusNotFound)
+	}
+}
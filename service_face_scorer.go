@@ -0,0 +1,18 @@
+package main
+
+// FaceScorer compares a selfie with a profile photo. A score from 0 to 1
+// only orders the admin queue of selfies; an admin always makes the
+// decision.
+type FaceScorer interface {
+	// score returns false when the scorer has no opinion.
+	score(selfie []byte, photo []byte) (float64, bool, error)
+}
+
+// faceScorer is replaced in main once a real scorer is available.
+var faceScorer FaceScorer = noopFaceScorer{}
+
+type noopFaceScorer struct{}
+
+func (noopFaceScorer) score(selfie []byte, photo []byte) (float64, bool, error) {
+	return 0, false, nil
+}
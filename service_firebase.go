@@ -33,13 +33,13 @@ func sendToClientDevices(n *Notification) bool {
 	})
 
 	if err != nil {
-		log.Fatal(err.Error())
+		log.Println(err.Error())
 		return false
 	}
 	d, e := json.Marshal(response)
 
 	if e != nil {
-		log.Fatal(err.Error())
+		log.Println(e.Error())
 		return false
 	}
 
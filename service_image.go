@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif" // register the GIF decoder
+	"image/jpeg"
+	"image/png"
+	"os"
+	"strconv"
+)
+
+const (
+	RenditionThumbnail = "thumbnail"
+	RenditionCard      = "card"
+	RenditionFull      = "full"
+)
+
+var (
+	errUnsupportedImage = errors.New("Unsupported image format")
+	errImageTooSmall    = errors.New("Image is too small")
+	errImageTooLarge    = errors.New("Image dimensions are too large")
+)
+
+// Rendition sizes in pixels. Thumbnails are cropped to a square, the others
+// keep their aspect ratio and are only ever scaled down.
+var renditionSizes = map[string]int{
+	RenditionThumbnail: 160,
+	RenditionCard:      480,
+	RenditionFull:      1280,
+}
+
+func getRenditions() []string {
+	return []string{RenditionThumbnail, RenditionCard, RenditionFull}
+}
+
+// ProcessedImage is an upload decoded, turned upright and re-encoded without
+// any metadata, together with its renditions.
+type ProcessedImage struct {
+	ContentType string
+	Ext         string
+	Width       int
+	Height      int
+	Original    []byte
+	Renditions  map[string][]byte
+}
+
+func getImageDimensionLimits() (int, int) {
+	min, err := strconv.Atoi(os.Getenv("VM_MEDIA_MIN_DIMENSION"))
+	if err != nil || min <= 0 {
+		min = 200
+	}
+
+	max, err := strconv.Atoi(os.Getenv("VM_MEDIA_MAX_DIMENSION"))
+	if err != nil || max <= 0 {
+		max = 8000
+	}
+
+	return min, max
+}
+
+// getImageMaxPixels caps width × height. A decoded image takes four bytes
+// per pixel and is copied while it is turned upright, so a highly
+// compressed 8000×8000 upload would otherwise need the best part of a
+// gigabyte.
+func getImageMaxPixels() int {
+	mp, err := strconv.Atoi(os.Getenv("VM_MEDIA_MAX_MEGAPIXELS"))
+	if err != nil || mp <= 0 {
+		mp = 24
+	}
+
+	return mp * 1000000
+}
+
+// processImage checks the data is an image we accept and prepares it for
+// storage. Re-encoding drops EXIF, including GPS coordinates, so the
+// orientation tag is applied to the pixels first.
+func processImage(data []byte) (*ProcessedImage, error) {
+	// Check dimensions before decoding so a small file cannot claim a huge
+	// canvas
+	cfg, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+
+	if format != "jpeg" && format != "png" && format != "gif" {
+		return nil, errUnsupportedImage
+	}
+
+	min, max := getImageDimensionLimits()
+
+	if cfg.Width > max || cfg.Height > max || cfg.Width*cfg.Height > getImageMaxPixels() {
+		return nil, errImageTooLarge
+	}
+
+	if cfg.Width < min || cfg.Height < min {
+		return nil, errImageTooSmall
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errUnsupportedImage
+	}
+
+	img := toNRGBA(src)
+
+	if format == "jpeg" {
+		img = orient(img, getJPEGOrientation(data))
+	}
+
+	p := &ProcessedImage{
+		Width:      img.Bounds().Dx(),
+		Height:     img.Bounds().Dy(),
+		Renditions: map[string][]byte{},
+	}
+
+	// Photos stay JPEG, anything that may have transparency becomes PNG.
+	// Only the first frame of an animated GIF is kept.
+	encode := encodePNG
+	p.ContentType, p.Ext = "image/png", ".png"
+
+	if format == "jpeg" {
+		encode = encodeJPEG
+		p.ContentType, p.Ext = "image/jpeg", ".jpg"
+	}
+
+	p.Original, err = encode(img)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, r := range getRenditions() {
+		var dst *image.NRGBA
+
+		if r == RenditionThumbnail {
+			dst = resizeToFill(img, renditionSizes[r])
+		} else {
+			dst = resizeToFit(img, renditionSizes[r])
+		}
+
+		p.Renditions[r], err = encode(dst)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func encodeJPEG(img *image.NRGBA) ([]byte, error) {
+	var b bytes.Buffer
+
+	err := jpeg.Encode(&b, img, &jpeg.Options{Quality: 85})
+
+	return b.Bytes(), err
+}
+
+func encodePNG(img *image.NRGBA) ([]byte, error) {
+	var b bytes.Buffer
+
+	err := png.Encode(&b, img)
+
+	return b.Bytes(), err
+}
+
+func toNRGBA(src image.Image) *image.NRGBA {
+	b := src.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+
+	return dst
+}
+
+// getJPEGOrientation reads the EXIF orientation tag (1 to 8) of a JPEG. It
+// returns 1, upright, when there is none.
+func getJPEGOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return 1
+		}
+
+		marker := data[i+1]
+		size := int(binary.BigEndian.Uint16(data[i+2:]))
+
+		// Start of scan, the metadata segments are over
+		if marker == 0xDA || size < 2 || i+2+size > len(data) {
+			return 1
+		}
+
+		seg := data[i+4 : i+2+size]
+		if marker == 0xE1 && len(seg) > 14 && string(seg[:6]) == "Exif\x00\x00" {
+			return getTIFFOrientation(seg[6:])
+		}
+
+		i += 2 + size
+	}
+
+	return 1
+}
+
+func getTIFFOrientation(tiff []byte) int {
+	var order binary.ByteOrder
+
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 1
+	}
+
+	count := int(order.Uint16(tiff[ifd:]))
+	for n := 0; n < count; n++ {
+		e := ifd + 2 + n*12
+		if e+12 > len(tiff) {
+			return 1
+		}
+
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			o := int(order.Uint16(tiff[e+8:]))
+			if o < 1 || o > 8 {
+				return 1
+			}
+
+			return o
+		}
+	}
+
+	return 1
+}
+
+// orient turns an image upright according to its EXIF orientation.
+func orient(src *image.NRGBA, orientation int) *image.NRGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+
+			switch orientation {
+			case 2:
+				dx, dy = w-1-x, y
+			case 3:
+				dx, dy = w-1-x, h-1-y
+			case 4:
+				dx, dy = x, h-1-y
+			case 5:
+				dx, dy = y, x
+			case 6:
+				dx, dy = h-1-y, x
+			case 7:
+				dx, dy = h-1-y, w-1-x
+			case 8:
+				dx, dy = y, w-1-x
+			}
+
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+
+	return dst
+}
+
+// resizeToFit scales an image down so its longest side is at most size.
+func resizeToFit(src *image.NRGBA, size int) *image.NRGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= size && h <= size {
+		return src
+	}
+
+	if w >= h {
+		return resize(src, src.Bounds(), size, h*size/w)
+	}
+
+	return resize(src, src.Bounds(), w*size/h, size)
+}
+
+// resizeToFill crops the centre square of an image and scales it to size.
+func resizeToFill(src *image.NRGBA, size int) *image.NRGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+
+	side := w
+	if h < side {
+		side = h
+	}
+
+	crop := image.Rect((w-side)/2, (h-side)/2, (w-side)/2+side, (h-side)/2+side)
+
+	if side < size {
+		size = side
+	}
+
+	return resize(src, crop, size, size)
+}
+
+// resize scales the part r of src to w by h, averaging the source pixels
+// that fall in each destination pixel.
+func resize(src *image.NRGBA, r image.Rectangle, w int, h int) *image.NRGBA {
+	if w < 1 {
+		w = 1
+	}
+
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, w, h))
+	sw, sh := r.Dx(), r.Dy()
+
+	for y := 0; y < h; y++ {
+		y0 := r.Min.Y + y*sh/h
+		y1 := r.Min.Y + (y+1)*sh/h
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+
+		for x := 0; x < w; x++ {
+			x0 := r.Min.X + x*sw/w
+			x1 := r.Min.X + (x+1)*sw/w
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var sum [4]int
+
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					o := src.PixOffset(sx, sy)
+					a := int(src.Pix[o+3])
+
+					// Weight colours by alpha so transparent pixels do not
+					// darken the edges
+					sum[0] += int(src.Pix[o]) * a
+					sum[1] += int(src.Pix[o+1]) * a
+					sum[2] += int(src.Pix[o+2]) * a
+					sum[3] += a
+				}
+			}
+
+			o := dst.PixOffset(x, y)
+			n := (y1 - y0) * (x1 - x0)
+
+			if sum[3] > 0 {
+				dst.Pix[o] = uint8(sum[0] / sum[3])
+				dst.Pix[o+1] = uint8(sum[1] / sum[3])
+				dst.Pix[o+2] = uint8(sum[2] / sum[3])
+			}
+
+			dst.Pix[o+3] = uint8(sum[3] / n)
+		}
+	}
+
+	return dst
+}
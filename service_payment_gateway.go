@@ -0,0 +1,371 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PaymentPending = "pending"
+	PaymentSuccess = "success"
+	PaymentFailed  = "failed"
+)
+
+// GatewayOrder is what the gateway needs to start a payment.
+type GatewayOrder struct {
+	TransactionID string
+	UserUUID      string
+	Amount        float64
+}
+
+// GatewayRefund returns part or all of a completed transaction.
+type GatewayRefund struct {
+	RefundID      string
+	TransactionID string
+	UserUUID      string
+	Amount        float64
+}
+
+// GatewayStatus is the gateway's own view of a transaction.
+type GatewayStatus struct {
+	TransactionID string
+	Status        string
+	Amount        float64
+	Code          string
+	Message       string
+	Data          json.RawMessage
+}
+
+// PaymentGateway talks to the payment provider. Payment state is only ever
+// taken from checkStatus, never from what a client posts.
+type PaymentGateway interface {
+	createOrder(o GatewayOrder) (redirectURL string, err error)
+	checkStatus(transactionID string) (GatewayStatus, error)
+	refund(r GatewayRefund) (GatewayStatus, error)
+	verifyCallback(body []byte, signature string) (transactionID string, err error)
+}
+
+var paymentGateway PaymentGateway
+
+// newPaymentGateway picks the gateway from VM_PAYMENT_GATEWAY. The fake
+// gateway is never used in production.
+func newPaymentGateway() PaymentGateway {
+	if os.Getenv("VM_PAYMENT_GATEWAY") == "fake" {
+		if os.Getenv("VM_ENVIRONMENT") != "production" {
+			return &fakeGateway{orders: make(map[string]GatewayOrder)}
+		}
+
+		log.Println("Fake payment gateway is not allowed in production")
+	}
+
+	return &phonePeGateway{}
+}
+
+type phonePeGateway struct{}
+
+func (g *phonePeGateway) baseURL() string {
+	if u := os.Getenv("VM_PHONEPE_BASE_URL"); u != "" {
+		return strings.TrimRight(u, "/")
+	}
+
+	return "https://api.phonepe.com/apis/hermes"
+}
+
+// checksum builds the X-VERIFY header: sha256(payload + salt key) ### salt index.
+func (g *phonePeGateway) checksum(payload string) string {
+	sum := sha256.Sum256([]byte(payload + os.Getenv("VM_PHONEPE_SALT_KEY")))
+
+	return hex.EncodeToString(sum[:]) + "###" + os.Getenv("VM_PHONEPE_SALT_INDEX")
+}
+
+func (g *phonePeGateway) do(req *http.Request, v interface{}) error {
+	client := &http.Client{
+		Timeout: time.Second * 30,
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+func (g *phonePeGateway) createOrder(o GatewayOrder) (string, error) {
+	var resp struct {
+		Success bool   `json:"success"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Data    struct {
+			InstrumentResponse struct {
+				RedirectInfo struct {
+					URL string `json:"url"`
+				} `json:"redirectInfo"`
+			} `json:"instrumentResponse"`
+		} `json:"data"`
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"merchantId":            os.Getenv("VM_PHONEPE_MERCHANT_ID"),
+		"merchantTransactionId": o.TransactionID,
+		"merchantUserId":        strings.Replace(o.UserUUID, "-", "", -1),
+		"amount":                int64(math.Round(o.Amount * 100)),
+		"redirectUrl":           os.Getenv("VM_PAYMENT_REDIRECT_URL"),
+		"redirectMode":          "POST",
+		"callbackUrl":           os.Getenv("VM_API_URL") + "/api/payments/callback",
+		"paymentInstrument":     map[string]string{"type": "PAY_PAGE"},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	request := base64.StdEncoding.EncodeToString(payload)
+
+	b, err := json.Marshal(map[string]string{"request": request})
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequest("POST", g.baseURL()+"/pg/v1/pay", bytes.NewBuffer(b))
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("X-VERIFY", g.checksum(request+"/pg/v1/pay"))
+
+	err = g.do(req, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	if !resp.Success || resp.Data.InstrumentResponse.RedirectInfo.URL == "" {
+		return "", errors.New("Payment gateway rejected order: " + resp.Code + " " + resp.Message)
+	}
+
+	return resp.Data.InstrumentResponse.RedirectInfo.URL, nil
+}
+
+func (g *phonePeGateway) checkStatus(transactionID string) (GatewayStatus, error) {
+	var resp struct {
+		Success bool            `json:"success"`
+		Code    string          `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+
+	s := GatewayStatus{TransactionID: transactionID, Status: PaymentPending}
+
+	path := "/pg/v1/status/" + os.Getenv("VM_PHONEPE_MERCHANT_ID") + "/" + transactionID
+
+	req, err := http.NewRequest("GET", g.baseURL()+path, nil)
+	if err != nil {
+		return s, err
+	}
+
+	req.Header.Set("X-VERIFY", g.checksum(path))
+	req.Header.Set("X-MERCHANT-ID", os.Getenv("VM_PHONEPE_MERCHANT_ID"))
+
+	err = g.do(req, &resp)
+	if err != nil {
+		return s, err
+	}
+
+	var data struct {
+		MerchantTransactionID string  `json:"merchantTransactionId"`
+		Amount                float64 `json:"amount"`
+		State                 string  `json:"state"`
+	}
+
+	_ = json.Unmarshal(resp.Data, &data)
+
+	if data.MerchantTransactionID != "" && data.MerchantTransactionID != transactionID {
+		return s, errors.New("Payment gateway returned a different transaction")
+	}
+
+	s.Code = resp.Code
+	s.Message = resp.Message
+	s.Data = resp.Data
+	s.Amount = data.Amount / 100
+
+	switch {
+	case resp.Code == "PAYMENT_SUCCESS" && data.State == "COMPLETED":
+		s.Status = PaymentSuccess
+	case isOneOf(resp.Code, []string{"PAYMENT_ERROR", "PAYMENT_DECLINED", "TIMED_OUT"}) || data.State == "FAILED":
+		s.Status = PaymentFailed
+	}
+
+	return s, nil
+}
+
+// refund starts a refund. Its final state is read with checkStatus using the
+// refund ID, as with payments.
+func (g *phonePeGateway) refund(r GatewayRefund) (GatewayStatus, error) {
+	var resp struct {
+		Success bool            `json:"success"`
+		Code    string          `json:"code"`
+		Message string          `json:"message"`
+		Data    json.RawMessage `json:"data"`
+	}
+
+	s := GatewayStatus{TransactionID: r.RefundID, Status: PaymentPending, Amount: r.Amount}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"merchantId":            os.Getenv("VM_PHONEPE_MERCHANT_ID"),
+		"merchantUserId":        strings.Replace(r.UserUUID, "-", "", -1),
+		"originalTransactionId": r.TransactionID,
+		"merchantTransactionId": r.RefundID,
+		"amount":                int64(math.Round(r.Amount * 100)),
+		"callbackUrl":           os.Getenv("VM_API_URL") + "/api/payments/callback",
+	})
+	if err != nil {
+		return s, err
+	}
+
+	request := base64.StdEncoding.EncodeToString(payload)
+
+	b, err := json.Marshal(map[string]string{"request": request})
+	if err != nil {
+		return s, err
+	}
+
+	req, err := http.NewRequest("POST", g.baseURL()+"/pg/v1/refund", bytes.NewBuffer(b))
+	if err != nil {
+		return s, err
+	}
+
+	req.Header.Set("X-VERIFY", g.checksum(request+"/pg/v1/refund"))
+
+	err = g.do(req, &resp)
+	if err != nil {
+		return s, err
+	}
+
+	s.Code = resp.Code
+	s.Message = resp.Message
+	s.Data = resp.Data
+
+	switch {
+	case resp.Code == "PAYMENT_SUCCESS":
+		s.Status = PaymentSuccess
+	case !resp.Success && resp.Code != "PAYMENT_PENDING":
+		s.Status = PaymentFailed
+	}
+
+	return s, nil
+}
+
+// verifyCallback checks the X-VERIFY header of a server-to-server callback,
+// which signs the base64 response with the salt key.
+func (g *phonePeGateway) verifyCallback(body []byte, signature string) (string, error) {
+	var (
+		payload struct {
+			Response string `json:"response"`
+		}
+		response struct {
+			Data struct {
+				MerchantTransactionID string `json:"merchantTransactionId"`
+			} `json:"data"`
+		}
+	)
+
+	if json.Unmarshal(body, &payload) != nil || payload.Response == "" {
+		return "", errors.New("Invalid callback")
+	}
+
+	if !hmac.Equal([]byte(g.checksum(payload.Response)), []byte(signature)) {
+		return "", errors.New("Invalid callback signature")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(payload.Response)
+	if err != nil {
+		return "", err
+	}
+
+	err = json.Unmarshal(b, &response)
+	if err != nil {
+		return "", err
+	}
+
+	return response.Data.MerchantTransactionID, nil
+}
+
+// fakeGateway completes every order it created. It signs callbacks with
+// VM_PAYMENT_FAKE_SECRET so local clients can simulate webhooks.
+type fakeGateway struct {
+	sync.Mutex
+	orders map[string]GatewayOrder
+}
+
+func (g *fakeGateway) createOrder(o GatewayOrder) (string, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	g.orders[o.TransactionID] = o
+
+	return os.Getenv("VM_PAYMENT_REDIRECT_URL") + "?transaction_id=" + o.TransactionID, nil
+}
+
+func (g *fakeGateway) checkStatus(transactionID string) (GatewayStatus, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	o, ok := g.orders[transactionID]
+	if !ok {
+		return GatewayStatus{}, errors.New("Unknown transaction")
+	}
+
+	return GatewayStatus{TransactionID: transactionID, Status: PaymentSuccess, Amount: o.Amount, Code: "PAYMENT_SUCCESS"}, nil
+}
+
+func (g *fakeGateway) refund(r GatewayRefund) (GatewayStatus, error) {
+	g.Lock()
+	defer g.Unlock()
+
+	if _, ok := g.orders[r.TransactionID]; !ok {
+		return GatewayStatus{}, errors.New("Unknown transaction")
+	}
+
+	g.orders[r.RefundID] = GatewayOrder{TransactionID: r.RefundID, UserUUID: r.UserUUID, Amount: r.Amount}
+
+	return GatewayStatus{TransactionID: r.RefundID, Status: PaymentSuccess, Amount: r.Amount, Code: "PAYMENT_SUCCESS"}, nil
+}
+
+func (g *fakeGateway) verifyCallback(body []byte, signature string) (string, error) {
+	var payload struct {
+		TransactionID string `json:"transaction_id"`
+	}
+
+	mac := hmac.New(sha256.New, []byte(os.Getenv("VM_PAYMENT_FAKE_SECRET")))
+	mac.Write(body)
+
+	if !hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(signature)) {
+		return "", errors.New("Invalid callback signature")
+	}
+
+	err := json.Unmarshal(body, &payload)
+
+	return payload.TransactionID, err
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+	"golang.org/x/net/websocket"
+)
+
+type realtimeClient struct {
+	userUUID string
+	send     chan []byte
+}
+
+type realtimeHub struct {
+	sync.RWMutex
+	clients map[string]map[*realtimeClient]bool
+}
+
+var hub = realtimeHub{clients: make(map[string]map[*realtimeClient]bool)}
+
+func (h *realtimeHub) register(c *realtimeClient) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.clients[c.userUUID] == nil {
+		h.clients[c.userUUID] = make(map[*realtimeClient]bool)
+	}
+
+	h.clients[c.userUUID][c] = true
+}
+
+func (h *realtimeHub) unregister(c *realtimeClient) {
+	h.Lock()
+	defer h.Unlock()
+
+	if _, ok := h.clients[c.userUUID][c]; !ok {
+		return
+	}
+
+	delete(h.clients[c.userUUID], c)
+	close(c.send)
+
+	if len(h.clients[c.userUUID]) == 0 {
+		delete(h.clients, c.userUUID)
+	}
+}
+
+// deliver hands a message to every connection of a member on this instance.
+// Slow connections are dropped and resume from their last event ID.
+func (h *realtimeHub) deliver(userUUID string, b []byte) {
+	var slow []*realtimeClient
+
+	h.RLock()
+	for c := range h.clients[userUUID] {
+		select {
+		case c.send <- b:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.RUnlock()
+
+	for _, c := range slow {
+		h.unregister(c)
+	}
+}
+
+func (h *realtimeHub) deliverTo(c *realtimeClient, b []byte) {
+	h.RLock()
+	defer h.RUnlock()
+
+	if _, ok := h.clients[c.userUUID][c]; !ok {
+		return
+	}
+
+	select {
+	case c.send <- b:
+	default:
+	}
+}
+
+func (h *realtimeHub) isConnected(userUUID string) bool {
+	h.RLock()
+	defer h.RUnlock()
+
+	return len(h.clients[userUUID]) > 0
+}
+
+// listenForEvents relays events published by any API instance to the members
+// connected to this one.
+func listenForEvents() {
+	l := pq.NewListener(os.Getenv("DATABASE_URL"), 10*time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("Realtime listener error: ", err.Error())
+		}
+	})
+
+	err := l.Listen(eventsChannel)
+	if err != nil {
+		log.Println("Unable to listen for events: ", err.Error())
+		return
+	}
+
+	for {
+		select {
+		case n := <-l.Notify:
+			if n == nil {
+				continue
+			}
+
+			handleEventNotification(n.Extra)
+		case <-time.After(90 * time.Second):
+			go l.Ping()
+		}
+	}
+}
+
+func handleEventNotification(extra string) {
+	var m eventMessage
+
+	err := json.Unmarshal([]byte(extra), &m)
+	if err != nil || m.UserUUID == "" {
+		return
+	}
+
+	to := m.UserUUID
+	if !hub.isConnected(to) {
+		return
+	}
+
+	if m.ID > 0 {
+		var e Event
+		if db.Where("id = ?", m.ID).First(&e).RecordNotFound() {
+			return
+		}
+
+		m = e.message()
+	}
+
+	m.UserUUID = ""
+
+	b, err := json.Marshal(m)
+	if err != nil {
+		return
+	}
+
+	hub.deliver(to, b)
+}
+
+// isAllowedOrigin reports whether a page may open a WebSocket with the
+// member's token. Browsers always send an Origin; native clients do not.
+func isAllowedOrigin(origin string) bool {
+	if origin == "" {
+		return true
+	}
+
+	for _, o := range strings.Split(os.Getenv("VM_ALLOWED_ORIGINS"), ",") {
+		if strings.TrimSpace(o) == origin {
+			return true
+		}
+	}
+
+	return false
+}
+
+func realtimeHandler(ctx echo.Context) error {
+	u, err := verifySession(ctx)
+	if err != nil {
+		return ctx.JSON(http.StatusUnauthorized, err.Error())
+	}
+
+	lastID, _ := strconv.ParseUint(ctx.QueryParam("last_event_id"), 10, 64)
+
+	// Other sites must not open a connection with the member's token
+	s := websocket.Server{
+		Handshake: func(_ *websocket.Config, req *http.Request) error {
+			if !isAllowedOrigin(req.Header.Get(echo.HeaderOrigin)) {
+				return errors.New("Origin not allowed")
+			}
+
+			return nil
+		},
+		Handler: func(ws *websocket.Conn) {
+			serveRealtimeClient(ws, u, lastID)
+		},
+	}
+
+	s.ServeHTTP(ctx.Response(), ctx.Request())
+
+	return nil
+}
+
+func serveRealtimeClient(ws *websocket.Conn, u User, lastID uint64) {
+	defer ws.Close()
+
+	c := &realtimeClient{userUUID: u.UUID, send: make(chan []byte, 256)}
+	hub.register(c)
+	defer hub.unregister(c)
+
+	go func() {
+		defer ws.Close()
+
+		for b := range c.send {
+			if websocket.Message.Send(ws, string(b)) != nil {
+				return
+			}
+		}
+	}()
+
+	// Replay what was missed; clients ignore IDs they have already seen. When
+	// too much was missed they are told to reload instead.
+	if lastID > 0 {
+		ee, complete := getEventsSince(u.UUID, lastID)
+
+		for _, e := range ee {
+			b, err := json.Marshal(e.message())
+			if err == nil {
+				hub.deliverTo(c, b)
+			}
+		}
+
+		if !complete {
+			b, err := json.Marshal(eventMessage{Type: EventResync, CreatedAt: time.Now()})
+			if err == nil {
+				hub.deliverTo(c, b)
+			}
+		}
+	}
+
+	for {
+		var in struct {
+			Type             string `json:"type"`
+			ConversationUUID string `json:"conversation_uuid"`
+		}
+
+		err := websocket.JSON.Receive(ws, &in)
+		if err != nil {
+			return
+		}
+
+		if in.Type != EventTyping {
+			continue
+		}
+
+		cv, err := getConversation(in.ConversationUUID, u.UUID)
+		if err != nil {
+			continue
+		}
+
+		to := cv.getOtherUUID(u.UUID)
+		if isBlocked(u.UUID, to) {
+			continue
+		}
+
+		publishEvent(to, EventTyping, map[string]string{
+			"conversation_uuid": cv.UUID,
+			"user_uuid":         u.UUID,
+		})
+	}
+}